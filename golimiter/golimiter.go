@@ -1,6 +1,7 @@
 package golimiter
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -30,3 +31,42 @@ func (l *Limiter) Action(weight uint64, f func() (interface{}, error)) (interfac
 		return nil, OverQuotaError
 	}
 }
+
+// Allow takes weight tokens if they are available, and returns whether it
+// took them.
+func (l *Limiter) Allow(weight uint64) bool {
+	return weight > 0 && !l.node.Reject(weight)
+}
+
+// Wait blocks until it takes weight tokens, or the context is done.
+func (l *Limiter) Wait(ctx context.Context, weight uint64) error {
+	if weight <= 0 {
+		return errors.New("weight must be positive")
+	}
+	if weight > l.capacity() {
+		return errors.New("weight exceeds the limiter capacity")
+	}
+
+	// Time to refill the tokens of the request
+	interval := time.Duration(weight) * time.Minute / time.Duration(l.maxRPM)
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	for !l.Allow(weight) {
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// capacity is the bucket size of the node, which can't hold less than a
+// refill.
+func (l *Limiter) capacity() uint64 {
+	return l.node.Capacity()
+}
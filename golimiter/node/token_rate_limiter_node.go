@@ -99,3 +99,9 @@ func (n *TokenRateNode) Reject(weight uint64) bool {
 		}
 	}
 }
+
+// Capacity returns the most tokens the bucket can hold.
+func (n *TokenRateNode) Capacity() uint64 {
+	state := (*TokenRateState)(atomic.LoadPointer(n.stateAddress()))
+	return state.capacity
+}
@@ -0,0 +1,129 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/matiasnu/go-jopit-toolkit/golimiter"
+	"github.com/matiasnu/go-jopit-toolkit/goutils/apierrors"
+)
+
+// Outcome classifies how a request went.
+type Outcome int
+
+const (
+	// OutcomeSuccess is a response with a status below 400
+	OutcomeSuccess Outcome = iota
+
+	// OutcomeClientError is a response with a 4xx status
+	OutcomeClientError
+
+	// OutcomeServerError is a response with a 5xx status
+	OutcomeServerError
+
+	// OutcomeTransportError is a request that got no response, see Response.Err
+	OutcomeTransportError
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeClientError:
+		return "client_error"
+	case OutcomeServerError:
+		return "server_error"
+	case OutcomeTransportError:
+		return "transport_error"
+	}
+	return "unknown"
+}
+
+// Outcome returns the classification of the response.
+func (r *Response) Outcome() Outcome {
+	switch {
+	case r.Err != nil || r.Response == nil:
+		return OutcomeTransportError
+	case r.StatusCode < http.StatusBadRequest:
+		return OutcomeSuccess
+	case r.StatusCode < http.StatusInternalServerError:
+		return OutcomeClientError
+	}
+	return OutcomeServerError
+}
+
+// ApiError returns nil on successful responses. Otherwise it returns the
+// error of the response as an apierrors.ApiError:
+//
+// Error responses with the apierrors JSON shape are decoded, keeping the
+// response status if the body has none. Any other error response is turned
+// into an ApiError with its status, whose cause is the raw body.
+//
+// Transport errors are turned into an ApiError with status 504 (Gateway
+// Timeout) for timeouts, 503 (Service Unavailable) for open circuit breakers,
+// 429 (Too Many Requests) for requests over the RateLimiter quota, and 502
+// (Bad Gateway) for any other error.
+func (r *Response) ApiError() apierrors.ApiError {
+	switch r.Outcome() {
+	case OutcomeSuccess:
+		return nil
+	case OutcomeTransportError:
+		return transportApiError(r.Err)
+	}
+
+	if apiErr, err := apierrors.NewCustomStatusApiErrorFromBytes(r.byteBody, r.StatusCode); err == nil &&
+		(apiErr.Message() != "" || apiErr.Code() != "") {
+		return apiErr
+	}
+
+	cause := apierrors.CauseList{}
+	if len(r.byteBody) > 0 {
+		cause = append(cause, r.String())
+	}
+
+	message := fmt.Sprintf("request failed with status %d", r.StatusCode)
+	if r.Request != nil {
+		redactor := r.redactor
+		if redactor == nil {
+			redactor = defaultRedactor
+		}
+		message = fmt.Sprintf("%s %s failed with status %d", r.Request.Method, redactor.url(r.Request.URL), r.StatusCode)
+	}
+
+	return apierrors.NewApiError(message, statusCode(r.StatusCode), r.StatusCode, cause)
+}
+
+func transportApiError(err error) apierrors.ApiError {
+	if err == nil {
+		err = errors.New("empty response")
+	}
+
+	var status int
+	var netErr net.Error
+	var circuitErr *CircuitOpenError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		status = http.StatusGatewayTimeout
+	case errors.As(err, &circuitErr):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, golimiter.OverQuotaError):
+		status = http.StatusTooManyRequests
+	default:
+		status = http.StatusBadGateway
+	}
+
+	return apierrors.NewApiError(err.Error(), statusCode(status), status, apierrors.CauseList{err.Error()})
+}
+
+// statusCode returns the error code of a status, like "not_found" for 404.
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "unknown_error"
+	}
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
@@ -0,0 +1,356 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BalancingPolicy is the way a LoadBalancer picks the endpoint of a request.
+type BalancingPolicy int
+
+const (
+	// RoundRobin picks the endpoints in turn
+	RoundRobin BalancingPolicy = iota
+
+	// Random picks a random endpoint
+	Random
+
+	// LeastOutstanding picks the endpoint with the fewest requests in flight
+	LeastOutstanding
+)
+
+// LoadBalancerConfig configures a LoadBalancer. Zero values take the defaults
+// described on each field.
+type LoadBalancerConfig struct {
+	Policy BalancingPolicy
+
+	// Consecutive failed requests, errors or 5xx responses, that eject an
+	// endpoint, 5 by default
+	MaxFailures int
+
+	// Time an ejected endpoint stays out of the balancing, 30s by default
+	EjectionTime time.Duration
+
+	// Optional path checked with a GET on every endpoint. Endpoints that don't
+	// respond it with a 2xx status are out of the balancing until they do.
+	HealthCheckPath string
+
+	// Time between health checks, 10s by default
+	HealthCheckInterval time.Duration
+
+	// Timeout of each health check, 2s by default
+	HealthCheckTimeout time.Duration
+
+	// Optional client used for the health checks
+	HealthCheckClient *http.Client
+}
+
+// EndpointStatus is the state of an endpoint of a LoadBalancer.
+type EndpointStatus struct {
+	URL         string
+	Healthy     bool
+	Ejected     bool
+	Outstanding int
+}
+
+type endpoint struct {
+	url         string
+	outstanding int64
+
+	// Guarded by the LoadBalancer mtx
+	failures     int
+	ejectedUntil time.Time
+	unhealthy    bool
+}
+
+// LoadBalancer spreads the requests of a RequestBuilder across several base
+// URLs, taking out of the balancing the endpoints that fail.
+//
+// It can be shared by several RequestBuilders.
+type LoadBalancer struct {
+	config    LoadBalancerConfig
+	endpoints []*endpoint
+	next      uint64
+
+	mtx  sync.Mutex
+	rand *rand.Rand
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLoadBalancer returns a LoadBalancer across the given base URLs. If the
+// config has a HealthCheckPath, it starts checking the endpoints until Close
+// is called.
+func NewLoadBalancer(baseURLs []string, config LoadBalancerConfig) *LoadBalancer {
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = 5
+	}
+	if config.EjectionTime <= 0 {
+		config.EjectionTime = 30 * time.Second
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = 10 * time.Second
+	}
+	if config.HealthCheckTimeout <= 0 {
+		config.HealthCheckTimeout = 2 * time.Second
+	}
+
+	lb := &LoadBalancer{
+		config: config,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:   make(chan struct{}),
+	}
+	for _, baseURL := range baseURLs {
+		lb.endpoints = append(lb.endpoints, &endpoint{url: strings.TrimSuffix(baseURL, "/")})
+	}
+
+	if config.HealthCheckPath != "" {
+		go lb.healthCheck()
+	}
+	return lb
+}
+
+// Close stops the health checks.
+func (lb *LoadBalancer) Close() {
+	lb.closeOnce.Do(func() {
+		close(lb.stop)
+	})
+}
+
+// Endpoints returns the state of every endpoint.
+func (lb *LoadBalancer) Endpoints() []EndpointStatus {
+	now := time.Now()
+
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	status := make([]EndpointStatus, len(lb.endpoints))
+	for i, ep := range lb.endpoints {
+		status[i] = EndpointStatus{
+			URL:         ep.url,
+			Healthy:     !ep.unhealthy,
+			Ejected:     now.Before(ep.ejectedUntil),
+			Outstanding: int(atomic.LoadInt64(&ep.outstanding)),
+		}
+	}
+	return status
+}
+
+// pick returns the endpoint of the next attempt of a request, preferring the
+// endpoints it didn't try yet. If every endpoint is out of the balancing, it
+// picks among all of them rather than failing the request.
+func (lb *LoadBalancer) pick(tried []*endpoint) (*endpoint, error) {
+	if len(lb.endpoints) == 0 {
+		return nil, errors.New("load balancer has no endpoints")
+	}
+
+	now := time.Now()
+
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	var available, untried []*endpoint
+	for _, ep := range lb.endpoints {
+		if ep.unhealthy || now.Before(ep.ejectedUntil) {
+			continue
+		}
+		available = append(available, ep)
+		if !containsEndpoint(tried, ep) {
+			untried = append(untried, ep)
+		}
+	}
+
+	candidates := untried
+	if len(candidates) == 0 {
+		candidates = available
+	}
+	if len(candidates) == 0 {
+		candidates = lb.endpoints
+	}
+
+	switch lb.config.Policy {
+	case Random:
+		return candidates[lb.rand.Intn(len(candidates))], nil
+	case LeastOutstanding:
+		// Start at a rotating offset so that ties are spread
+		start := int(lb.next % uint64(len(candidates)))
+		lb.next++
+		best := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			ep := candidates[(start+i)%len(candidates)]
+			if atomic.LoadInt64(&ep.outstanding) < atomic.LoadInt64(&best.outstanding) {
+				best = ep
+			}
+		}
+		return best, nil
+	}
+
+	ep := candidates[lb.next%uint64(len(candidates))]
+	lb.next++
+	return ep, nil
+}
+
+func (lb *LoadBalancer) start(ep *endpoint) {
+	atomic.AddInt64(&ep.outstanding, 1)
+}
+
+// release ends a request to the endpoint without recording its outcome.
+func (lb *LoadBalancer) release(ep *endpoint) {
+	atomic.AddInt64(&ep.outstanding, -1)
+}
+
+// done ends a request to the endpoint, recording its outcome.
+func (lb *LoadBalancer) done(ep *endpoint, success bool) {
+	lb.release(ep)
+	lb.record(ep, success)
+}
+
+// record counts the outcome of a request to the endpoint, ejecting it after
+// MaxFailures consecutive failures.
+func (lb *LoadBalancer) record(ep *endpoint, success bool) {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	if success {
+		ep.failures = 0
+		return
+	}
+
+	ep.failures++
+	if ep.failures >= lb.config.MaxFailures {
+		ep.failures = 0
+		ep.ejectedUntil = time.Now().Add(lb.config.EjectionTime)
+	}
+}
+
+func (lb *LoadBalancer) healthCheck() {
+	client := lb.config.HealthCheckClient
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	ticker := time.NewTicker(lb.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, ep := range lb.endpoints {
+			wg.Add(1)
+			go func(ep *endpoint) {
+				defer wg.Done()
+				healthy := lb.check(client, ep)
+
+				lb.mtx.Lock()
+				ep.unhealthy = !healthy
+				lb.mtx.Unlock()
+			}(ep)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-lb.stop:
+			return
+		}
+	}
+}
+
+func (lb *LoadBalancer) check(client *http.Client, ep *endpoint) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), lb.config.HealthCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.url+lb.config.HealthCheckPath, nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	drainBody(resp.Body)
+
+	return resp.StatusCode/100 == 2
+}
+
+// balancedRequest is the load balancing of an attempt, kept in its context
+// so that hedged attempts can pick their own endpoint.
+type balancedRequest struct {
+	lb   *LoadBalancer
+	path string
+	ep   *endpoint
+
+	// Set once hedging records the outcome of the attempt to ep, which then
+	// is only released by its sender
+	hedged bool
+}
+
+type balancedRequestKey struct{}
+
+func withBalancedRequest(req *http.Request, b *balancedRequest) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), balancedRequestKey{}, b))
+}
+
+func balancedRequestOf(req *http.Request) *balancedRequest {
+	b, _ := req.Context().Value(balancedRequestKey{}).(*balancedRequest)
+	return b
+}
+
+// retarget points req to an endpoint out of used, returning it. It returns
+// nil, keeping the endpoint of req, if there is no other one.
+func (b *balancedRequest) retarget(req *http.Request, used []*endpoint) *endpoint {
+	ep, err := b.lb.pick(used)
+	if err != nil || containsEndpoint(used, ep) {
+		return nil
+	}
+
+	requestURL := ep.url + b.path
+	resourceURL, err := parseURL(requestURL)
+	if err != nil {
+		return nil
+	}
+	target, err := url.Parse(resourceURL)
+	if err != nil {
+		return nil
+	}
+
+	req.URL = target
+	req.Host = target.Host
+	if mockUpEnv {
+		req.Header.Set("X-Original-URL", requestURL)
+	}
+
+	b.lb.start(ep)
+	return ep
+}
+
+// done records the outcome of an attempt sent to ep by retarget.
+func (b *balancedRequest) done(ep *endpoint, req *http.Request, result *Response) {
+	b.lb.release(ep)
+	b.record(ep, req, result)
+}
+
+// record counts the outcome of an attempt to ep, unless it was canceled,
+// which says nothing of the endpoint.
+func (b *balancedRequest) record(ep *endpoint, req *http.Request, result *Response) {
+	if req.Context().Err() == nil {
+		b.lb.record(ep, isSuccess(result))
+	}
+}
+
+func containsEndpoint(endpoints []*endpoint, ep *endpoint) bool {
+	for _, e := range endpoints {
+		if e == ep {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,449 @@
+package rest
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matiasnu/go-jopit-toolkit/goutils"
+)
+
+// DefaultMaxCacheSize is the maximum amount of bytes the default ResourceCache
+// of a RequestBuilder may hold before evicting the least recently used entries.
+var DefaultMaxCacheSize = 100 * 1024 * 1024
+
+// ResourceCache is the storage used by a RequestBuilder with EnableCache set
+// to keep the responses of cacheable verbs (GET, HEAD and OPTIONS).
+//
+// Implementations must be safe for concurrent use. The RequestBuilder never
+// modifies an entry after handing it to Set, and neither should the cache.
+type ResourceCache interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+	Delete(key string)
+}
+
+// CacheEntry is a cached response, together with what is needed to decide
+// whether it can be served to a later request.
+type CacheEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// Values of the request headers named by the response Vary header
+	VaryHeaders http.Header
+
+	// Moment until the entry can be served without going to the server
+	Expires time.Time
+
+	// Windows after Expires in which the stale entry may still be served,
+	// while revalidating in background or when the server fails.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+// Fresh returns true if the entry can still be served at the given time.
+func (e *CacheEntry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *CacheEntry) staleWhileRevalidate(now time.Time) bool {
+	return now.Before(e.Expires.Add(e.StaleWhileRevalidate))
+}
+
+func (e *CacheEntry) staleIfError(now time.Time) bool {
+	return now.Before(e.Expires.Add(e.StaleIfError))
+}
+
+// setValidators makes the request conditional on the entry validators,
+// unless the caller already made it conditional. It returns true if any
+// validator was added.
+func (e *CacheEntry) setValidators(req *http.Request) bool {
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+
+	conditional := false
+	if etag := e.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+		conditional = true
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+		conditional = true
+	}
+	return conditional
+}
+
+// refresh returns a copy of the entry updated with the headers of a
+// 304 (Not Modified) response.
+func (e *CacheEntry) refresh(resp *http.Response, now time.Time) *CacheEntry {
+	header := e.Header.Clone()
+	for k, values := range resp.Header {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		header[k] = values
+	}
+
+	refreshed := *e
+	refreshed.Header = header
+	refreshed.Expires = now
+	refreshed.StaleWhileRevalidate, refreshed.StaleIfError = staleWindows(cacheDirectives(header))
+
+	if ttl, ok := freshnessLifetime(header, now); ok && ttl > 0 && !cacheDirectives(header).has("no-cache") {
+		refreshed.Expires = now.Add(ttl)
+	}
+
+	return &refreshed
+}
+
+func (e *CacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+func (e *CacheEntry) size() int {
+	size := len(e.Body)
+	for k, values := range e.Header {
+		size += len(k)
+		for _, v := range values {
+			size += len(v)
+		}
+	}
+	return size
+}
+
+// matches checks that the request carries the same values, for the headers
+// named in Vary, as the one that produced the entry.
+func (e *CacheEntry) matches(req *http.Request) bool {
+	for k := range e.VaryHeaders {
+		if e.VaryHeaders.Get(k) != req.Header.Get(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// response returns the entry as a response, with its own copy of the body
+// so that the caller can't modify the cached one.
+func (e *CacheEntry) response(req *http.Request) *Response {
+	return &Response{
+		Response: &http.Response{
+			Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+			StatusCode:    e.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        e.Header.Clone(),
+			Body:          http.NoBody,
+			ContentLength: int64(len(e.Body)),
+			Request:       req,
+		},
+		byteBody: append([]byte(nil), e.Body...),
+	}
+}
+
+// NewLRUCache returns an in-memory ResourceCache that holds up to maxSize
+// bytes, evicting the least recently used entries when full.
+func NewLRUCache(maxSize int) ResourceCache {
+	return &lruCache{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+type lruCache struct {
+	mtx     sync.Mutex
+	maxSize int
+	size    int
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	entry *CacheEntry
+	size  int
+}
+
+func (c *lruCache) Get(key string) (*CacheEntry, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*lruItem).entry, true
+}
+
+func (c *lruCache) Set(key string, entry *CacheEntry) {
+	size := len(key) + entry.size()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+
+	if size > c.maxSize {
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruItem{key, entry, size})
+	c.size += size
+
+	for c.size > c.maxSize {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *lruCache) Delete(key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *lruCache) remove(elem *list.Element) {
+	item := c.ll.Remove(elem).(*lruItem)
+	delete(c.items, item.key)
+	c.size -= item.size
+}
+
+// Status codes that may be cached when the response carries freshness info.
+var cacheableStatus = map[int]struct{}{
+	http.StatusOK:                   struct{}{},
+	http.StatusNonAuthoritativeInfo: struct{}{},
+	http.StatusNoContent:            struct{}{},
+	http.StatusMultipleChoices:      struct{}{},
+	http.StatusMovedPermanently:     struct{}{},
+	http.StatusNotFound:             struct{}{},
+	http.StatusGone:                 struct{}{},
+}
+
+func (rb *RequestBuilder) getCache() ResourceCache {
+	rb.cacheMtxOnce.Do(func() {
+		if rb.ResourceCache == nil {
+			rb.ResourceCache = NewLRUCache(DefaultMaxCacheSize)
+		}
+	})
+
+	return rb.ResourceCache
+}
+
+// revalidate refreshes a stale entry in background, with at most one
+// revalidation in flight per key.
+func (rb *RequestBuilder) revalidate(key string, verb string, requestURL string, opt reqOptions) {
+	if _, loaded := rb.revalidations.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	// The revalidation outlives the call that triggered it
+	opt.ctx = detachedContext{opt.Context()}
+	opt.revalidate = true
+	go func() {
+		defer rb.revalidations.Delete(key)
+		defer goutils.Recover()
+		rb.doRequest(verb, requestURL, nil, opt)
+	}()
+}
+
+// cacheKey returns the key of a request, which includes a hash of its
+// credentials so that a response is only served to the principal that got it.
+func cacheKey(verb string, resourceURL string, header http.Header) string {
+	key := verb + " " + resourceURL
+
+	hash := sha256.New()
+	credentials := false
+	for _, name := range credentialHeaders {
+		values := header.Values(name)
+		if len(values) > 0 {
+			credentials = true
+		}
+		hash.Write([]byte(name + ": " + strings.Join(values, ",") + "\n"))
+	}
+	if credentials {
+		key += " " + hex.EncodeToString(hash.Sum(nil))
+	}
+	return key
+}
+
+// cacheLookup returns the entry stored for the request, fresh or not, or nil
+// if there is none or the request must not be served from cache.
+func cacheLookup(cache ResourceCache, key string, req *http.Request) *CacheEntry {
+	if cacheDirectives(req.Header).has("no-store") {
+		return nil
+	}
+
+	entry, ok := cache.Get(key)
+	if !ok || !entry.matches(req) {
+		return nil
+	}
+
+	return entry
+}
+
+// cacheStore saves the response in the cache if its headers allow it, and
+// removes any previous entry for the key otherwise.
+//
+// A 304 (Not Modified) only reaches it when the caller made the request
+// conditional, so it says nothing about the stored entry.
+func cacheStore(cache ResourceCache, key string, result *Response) {
+	if result.Err != nil || result.StatusCode == http.StatusNotModified {
+		return
+	}
+
+	entry := newCacheEntry(result, time.Now())
+	if entry == nil {
+		cache.Delete(key)
+		return
+	}
+
+	cache.Set(key, entry)
+}
+
+// cacheRevalidated handles the server answer to a conditional request. On a
+// 304 (Not Modified) the stored entry is refreshed and returned as the
+// response, any other answer is stored as a regular response.
+func cacheRevalidated(cache ResourceCache, key string, entry *CacheEntry, result *Response) *Response {
+	if result.Err != nil || result.StatusCode != http.StatusNotModified {
+		cacheStore(cache, key, result)
+		return result
+	}
+
+	refreshed := entry.refresh(result.Response, time.Now())
+	cache.Set(key, refreshed)
+
+	return refreshed.response(result.Request)
+}
+
+func newCacheEntry(result *Response, now time.Time) *CacheEntry {
+	if _, ok := cacheableStatus[result.StatusCode]; !ok {
+		return nil
+	}
+
+	req := result.Request
+	if req != nil && cacheDirectives(req.Header).has("no-store") {
+		return nil
+	}
+
+	directives := cacheDirectives(result.Header)
+	if directives.has("no-store") || directives.has("private") {
+		return nil
+	}
+
+	entry := &CacheEntry{
+		StatusCode:  result.StatusCode,
+		Header:      result.Header.Clone(),
+		Body:        append([]byte(nil), result.byteBody...),
+		VaryHeaders: make(http.Header),
+		Expires:     now,
+	}
+
+	// Responses without freshness info, or marked as no-cache, are kept
+	// only if they can be revalidated.
+	ttl, ok := freshnessLifetime(result.Header, now)
+	if ok && ttl > 0 && !directives.has("no-cache") {
+		entry.Expires = now.Add(ttl)
+	} else if !entry.hasValidators() {
+		return nil
+	}
+
+	entry.StaleWhileRevalidate, entry.StaleIfError = staleWindows(directives)
+
+	for _, vary := range result.Header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name != "" && req != nil {
+				entry.VaryHeaders.Set(name, req.Header.Get(name))
+			}
+		}
+	}
+
+	return entry
+}
+
+// staleWindows returns the stale-while-revalidate and stale-if-error
+// windows, which must-revalidate forbids.
+func staleWindows(d directives) (time.Duration, time.Duration) {
+	if d.has("must-revalidate") || d.has("proxy-revalidate") {
+		return 0, 0
+	}
+	return d.seconds("stale-while-revalidate"), d.seconds("stale-if-error")
+}
+
+// freshnessLifetime returns how long a response can be served from cache,
+// based on its max-age (or s-maxage) directive, falling back to Expires.
+func freshnessLifetime(header http.Header, now time.Time) (time.Duration, bool) {
+	if m := maxAge.FindStringSubmatch(header.Get("Cache-Control")); m != nil {
+		seconds, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false
+		}
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		return exp.Sub(now), true
+	}
+
+	return 0, false
+}
+
+// directives holds the parsed Cache-Control directives of a header, with
+// their lowercase names as keys.
+type directives map[string]string
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+func (d directives) seconds(name string) time.Duration {
+	seconds, err := strconv.Atoi(d[name])
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func cacheDirectives(header http.Header) directives {
+	d := make(directives)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, arg = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			d[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return d
+}
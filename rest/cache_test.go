@@ -0,0 +1,222 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cacheServer answers each request with the reply of its handler, recording
+// the If-None-Match header of the last request.
+type cacheServer struct {
+	*httptest.Server
+
+	mtx         sync.Mutex
+	hits        int
+	ifNoneMatch string
+}
+
+type cacheReply struct {
+	status int
+	header http.Header
+	body   string
+}
+
+func newCacheServer(t *testing.T, handler func(hit int, r *http.Request) cacheReply) *cacheServer {
+	t.Helper()
+
+	s := &cacheServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mtx.Lock()
+		s.hits++
+		s.ifNoneMatch = r.Header.Get("If-None-Match")
+		hit := s.hits
+		s.mtx.Unlock()
+
+		reply := handler(hit, r)
+		for k, values := range reply.header {
+			w.Header()[k] = values
+		}
+		w.WriteHeader(reply.status)
+		w.Write([]byte(reply.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *cacheServer) state() (int, string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.hits, s.ifNoneMatch
+}
+
+// etagHandler answers with the "v1" ETag, and 304 to requests that have it.
+func etagHandler(cacheControl string) func(int, *http.Request) cacheReply {
+	return func(hit int, r *http.Request) cacheReply {
+		header := http.Header{"Etag": {`"v1"`}, "Cache-Control": {cacheControl}}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			return cacheReply{status: http.StatusNotModified, header: header}
+		}
+		return cacheReply{status: http.StatusOK, header: header, body: "v1"}
+	}
+}
+
+func TestCache(t *testing.T) {
+	type step struct {
+		header      http.Header
+		mutate      bool
+		wantStatus  int
+		wantBody    string
+		wantServer  bool
+		ifNoneMatch string
+	}
+
+	tests := []struct {
+		name    string
+		handler func(hit int, r *http.Request) cacheReply
+		steps   []step
+	}{
+		{
+			name: "fresh response is served from cache",
+			handler: func(int, *http.Request) cacheReply {
+				return cacheReply{status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}}, body: "v1"}
+			},
+			steps: []step{
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true},
+				{wantStatus: http.StatusOK, wantBody: "v1"},
+			},
+		},
+		{
+			name: "callers modifying the body don't corrupt the cache",
+			handler: func(int, *http.Request) cacheReply {
+				return cacheReply{status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}}, body: "v1"}
+			},
+			steps: []step{
+				{mutate: true, wantStatus: http.StatusOK, wantBody: "v1", wantServer: true},
+				{mutate: true, wantStatus: http.StatusOK, wantBody: "v1"},
+				{wantStatus: http.StatusOK, wantBody: "v1"},
+			},
+		},
+		{
+			name: "no-store response is not cached",
+			handler: func(int, *http.Request) cacheReply {
+				return cacheReply{status: http.StatusOK, header: http.Header{"Cache-Control": {"no-store, max-age=60"}}, body: "v1"}
+			},
+			steps: []step{
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true},
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true},
+			},
+		},
+		{
+			name: "different Vary header goes to the server",
+			handler: func(hit int, r *http.Request) cacheReply {
+				header := http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}
+				return cacheReply{status: http.StatusOK, header: header, body: r.Header.Get("Accept-Language")}
+			},
+			steps: []step{
+				{header: http.Header{"Accept-Language": {"en"}}, wantStatus: http.StatusOK, wantBody: "en", wantServer: true},
+				{header: http.Header{"Accept-Language": {"en"}}, wantStatus: http.StatusOK, wantBody: "en"},
+				{header: http.Header{"Accept-Language": {"es"}}, wantStatus: http.StatusOK, wantBody: "es", wantServer: true},
+			},
+		},
+		{
+			name: "responses are not shared between credentials",
+			handler: func(hit int, r *http.Request) cacheReply {
+				header := http.Header{"Cache-Control": {"max-age=60"}}
+				return cacheReply{status: http.StatusOK, header: header, body: r.Header.Get("Authorization") + r.Header.Get("Cookie")}
+			},
+			steps: []step{
+				{header: http.Header{"Authorization": {"Bearer alice"}}, wantStatus: http.StatusOK, wantBody: "Bearer alice", wantServer: true},
+				{header: http.Header{"Authorization": {"Bearer alice"}}, wantStatus: http.StatusOK, wantBody: "Bearer alice"},
+				{header: http.Header{"Authorization": {"Bearer bob"}}, wantStatus: http.StatusOK, wantBody: "Bearer bob", wantServer: true},
+				{header: http.Header{"Cookie": {"session=alice"}}, wantStatus: http.StatusOK, wantBody: "session=alice", wantServer: true},
+				{wantStatus: http.StatusOK, wantBody: "", wantServer: true},
+			},
+		},
+		{
+			name:    "stale entry is revalidated with its ETag",
+			handler: etagHandler("no-cache"),
+			steps: []step{
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true},
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true, ifNoneMatch: `"v1"`},
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true, ifNoneMatch: `"v1"`},
+			},
+		},
+		{
+			name: "304 refreshes the freshness of the entry",
+			handler: func(hit int, r *http.Request) cacheReply {
+				if hit == 1 {
+					return etagHandler("no-cache")(hit, r)
+				}
+				return etagHandler("max-age=60")(hit, r)
+			},
+			steps: []step{
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true},
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true, ifNoneMatch: `"v1"`},
+				{wantStatus: http.StatusOK, wantBody: "v1"},
+			},
+		},
+		{
+			name:    "304 to a conditional request of the caller keeps the entry",
+			handler: etagHandler("no-cache"),
+			steps: []step{
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true},
+				{header: http.Header{"If-None-Match": {`"v1"`}}, wantStatus: http.StatusNotModified, wantServer: true, ifNoneMatch: `"v1"`},
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true, ifNoneMatch: `"v1"`},
+			},
+		},
+		{
+			name: "stale entry is served on server errors",
+			handler: func(hit int, r *http.Request) cacheReply {
+				if hit == 1 {
+					return etagHandler("max-age=0, stale-if-error=60")(hit, r)
+				}
+				return cacheReply{status: http.StatusInternalServerError, body: "error"}
+			},
+			steps: []step{
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true},
+				{wantStatus: http.StatusOK, wantBody: "v1", wantServer: true, ifNoneMatch: `"v1"`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newCacheServer(t, tt.handler)
+			rb := &RequestBuilder{
+				BaseURL:       server.URL,
+				Timeout:       5 * time.Second,
+				EnableCache:   true,
+				ResourceCache: NewLRUCache(DefaultMaxCacheSize),
+			}
+
+			for i, step := range tt.steps {
+				before, _ := server.state()
+
+				resp := rb.Get("/resource", Headers(step.header))
+				if resp.Err != nil {
+					t.Fatalf("step %d: unexpected error: %v", i, resp.Err)
+				}
+				if resp.StatusCode != step.wantStatus || resp.String() != step.wantBody {
+					t.Fatalf("step %d: got %d %q, expected %d %q", i, resp.StatusCode, resp.String(), step.wantStatus, step.wantBody)
+				}
+
+				hits, ifNoneMatch := server.state()
+				if got := hits > before; got != step.wantServer {
+					t.Fatalf("step %d: request reached the server: %t, expected %t", i, got, step.wantServer)
+				}
+				if step.wantServer && ifNoneMatch != step.ifNoneMatch {
+					t.Fatalf("step %d: server got If-None-Match %q, expected %q", i, ifNoneMatch, step.ifNoneMatch)
+				}
+
+				if step.mutate {
+					for j := range resp.Bytes() {
+						resp.Bytes()[j] = 'x'
+					}
+				}
+			}
+		})
+	}
+}
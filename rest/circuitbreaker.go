@@ -0,0 +1,343 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every request through
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen fails every request fast, until OpenTimeout elapses
+	CircuitOpen
+
+	// CircuitHalfOpen lets a few probe requests through to decide whether
+	// the circuit closes again
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitOpenError is set as Response.Err on the requests rejected by a
+// CircuitBreaker.
+type CircuitOpenError struct {
+	Name  string
+	State CircuitState
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker %s is %s", e.Name, e.State)
+}
+
+// CircuitBreakerConfig configures a CircuitBreaker. Zero values take the
+// defaults described on each field.
+type CircuitBreakerConfig struct {
+	// Rolling window used to compute the error rate, 10s by default
+	Window time.Duration
+
+	// Minimum requests in the window before the error rate may open the
+	// circuit, 20 by default
+	MinRequests int
+
+	// Error rate, from 0 to 1, that opens the circuit. 0 disables it, unless
+	// ConsecutiveFailures is 0 too, which sets it to 0.5.
+	ErrorRate float64
+
+	// Consecutive failures that open the circuit. 0 disables it.
+	ConsecutiveFailures int
+
+	// Time the circuit stays open before letting probes through, 5s by default
+	OpenTimeout time.Duration
+
+	// Successful probes needed to close the circuit, 1 by default
+	HalfOpenRequests int
+
+	// Optional callback, called on every state transition
+	OnStateChange func(name string, from CircuitState, to CircuitState)
+}
+
+// Number of buckets the rolling window is split into
+const circuitBuckets = 10
+
+type circuitBucket struct {
+	epoch     int64
+	successes int
+	failures  int
+}
+
+// CircuitBreaker stops sending requests to a failing downstream for a while,
+// failing them fast with a CircuitOpenError instead.
+//
+// It can be set on a RequestBuilder, or on a CustomPool to be shared by all
+// the RequestBuilders that use it. Only the attempts sent to the network go
+// through it, responses served from the cache don't.
+type CircuitBreaker struct {
+	name   string
+	config CircuitBreakerConfig
+
+	mtx         sync.Mutex
+	state       CircuitState
+	generation  uint64
+	openedAt    time.Time
+	consecutive int
+	probes      int
+	successes   int
+	buckets     [circuitBuckets]circuitBucket
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker. The name identifies it
+// in errors and callbacks.
+func NewCircuitBreaker(name string, config CircuitBreakerConfig) *CircuitBreaker {
+	if config.Window <= 0 {
+		config.Window = 10 * time.Second
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = 20
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = 5 * time.Second
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = 1
+	}
+	if config.ErrorRate <= 0 && config.ConsecutiveFailures <= 0 {
+		config.ErrorRate = 0.5
+	}
+	return &CircuitBreaker{name: name, config: config}
+}
+
+// State returns the current state of the circuit.
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	state, _ := cb.current(time.Now())
+	return state
+}
+
+// circuitCall is a request let through by a CircuitBreaker.
+type circuitCall struct {
+	cb         *CircuitBreaker
+	generation uint64
+}
+
+// done records the outcome of the request.
+func (c circuitCall) done(success bool) {
+	c.cb.done(c.generation, success)
+}
+
+// abandon releases the request without recording its outcome, which says
+// nothing about the downstream when its caller gave up on it.
+func (c circuitCall) abandon() {
+	c.cb.abandon(c.generation)
+}
+
+// allow checks whether a request may go through. If it may, it returns the
+// call to report the request outcome to.
+func (cb *CircuitBreaker) allow() (*circuitCall, error) {
+	now := time.Now()
+
+	cb.mtx.Lock()
+	from := cb.state
+	state, generation := cb.current(now)
+
+	var err error
+	switch {
+	case state == CircuitOpen:
+		err = &CircuitOpenError{cb.name, state}
+	case state == CircuitHalfOpen && cb.probes >= cb.config.HalfOpenRequests:
+		err = &CircuitOpenError{cb.name, state}
+	case state == CircuitHalfOpen:
+		cb.probes++
+	}
+	cb.mtx.Unlock()
+
+	cb.notify(from, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &circuitCall{cb, generation}, nil
+}
+
+func (cb *CircuitBreaker) done(generation uint64, success bool) {
+	now := time.Now()
+
+	cb.mtx.Lock()
+	from := cb.state
+	state, current := cb.current(now)
+
+	// Outcomes of requests started on a previous state don't count
+	if generation != current {
+		cb.mtx.Unlock()
+		cb.notify(from, state)
+		return
+	}
+
+	switch state {
+	case CircuitClosed:
+		cb.record(now, success)
+		if cb.tripped(now) {
+			cb.setState(CircuitOpen, now)
+		}
+	case CircuitHalfOpen:
+		if !success {
+			cb.setState(CircuitOpen, now)
+			break
+		}
+		cb.successes++
+		if cb.successes >= cb.config.HalfOpenRequests {
+			cb.setState(CircuitClosed, now)
+		}
+	}
+	to := cb.state
+	cb.mtx.Unlock()
+
+	cb.notify(from, to)
+}
+
+func (cb *CircuitBreaker) abandon(generation uint64) {
+	now := time.Now()
+
+	cb.mtx.Lock()
+	from := cb.state
+	state, current := cb.current(now)
+
+	// Let another probe through instead
+	if generation == current && state == CircuitHalfOpen {
+		cb.probes--
+	}
+	cb.mtx.Unlock()
+
+	cb.notify(from, state)
+}
+
+// current moves an open circuit to half-open once its timeout elapsed, and
+// returns the state and its generation. Must be called with the lock held.
+func (cb *CircuitBreaker) current(now time.Time) (CircuitState, uint64) {
+	if cb.state == CircuitOpen && now.Sub(cb.openedAt) >= cb.config.OpenTimeout {
+		cb.setState(CircuitHalfOpen, now)
+	}
+	return cb.state, cb.generation
+}
+
+func (cb *CircuitBreaker) setState(state CircuitState, now time.Time) {
+	cb.state = state
+	cb.generation++
+	cb.consecutive = 0
+	cb.probes = 0
+	cb.successes = 0
+
+	switch state {
+	case CircuitOpen:
+		cb.openedAt = now
+	case CircuitClosed:
+		cb.buckets = [circuitBuckets]circuitBucket{}
+	}
+}
+
+func (cb *CircuitBreaker) record(now time.Time, success bool) {
+	epoch := cb.epoch(now)
+	b := &cb.buckets[epoch%circuitBuckets]
+	if b.epoch != epoch {
+		*b = circuitBucket{epoch: epoch}
+	}
+
+	if success {
+		b.successes++
+		cb.consecutive = 0
+	} else {
+		b.failures++
+		cb.consecutive++
+	}
+}
+
+func (cb *CircuitBreaker) tripped(now time.Time) bool {
+	if cb.config.ConsecutiveFailures > 0 && cb.consecutive >= cb.config.ConsecutiveFailures {
+		return true
+	}
+
+	if cb.config.ErrorRate <= 0 {
+		return false
+	}
+
+	var successes, failures int
+	epoch := cb.epoch(now)
+	for _, b := range cb.buckets {
+		if b.epoch > epoch-circuitBuckets {
+			successes += b.successes
+			failures += b.failures
+		}
+	}
+
+	total := successes + failures
+	return total >= cb.config.MinRequests && float64(failures)/float64(total) >= cb.config.ErrorRate
+}
+
+func (cb *CircuitBreaker) epoch(now time.Time) int64 {
+	width := int64(cb.config.Window / circuitBuckets)
+	if width < 1 {
+		width = 1
+	}
+	return now.UnixNano() / width
+}
+
+func (cb *CircuitBreaker) notify(from CircuitState, to CircuitState) {
+	if from != to && cb.config.OnStateChange != nil {
+		cb.config.OnStateChange(cb.name, from, to)
+	}
+}
+
+// intercept returns a handler that sends the request with next only if the
+// breaker allows it, and records its outcome.
+func (cb *CircuitBreaker) intercept(next Handler) Handler {
+	return func(req *http.Request) *Response {
+		call, err := cb.allow()
+		if err != nil {
+			return &Response{Err: err}
+		}
+
+		result := next(req)
+
+		// Attempts given up by the caller or by hedging don't count as
+		// failures of the downstream
+		if req.Context().Err() != nil {
+			call.abandon()
+		} else {
+			call.done(isSuccess(result))
+		}
+		return result
+	}
+}
+
+func isCircuitOpen(err error) bool {
+	var circuitErr *CircuitOpenError
+	return errors.As(err, &circuitErr)
+}
+
+func (rb *RequestBuilder) getCircuitBreaker() *CircuitBreaker {
+	if rb.CircuitBreaker != nil {
+		return rb.CircuitBreaker
+	}
+	if cp := rb.CustomPool; cp != nil {
+		return cp.CircuitBreaker
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// outcomes reports a request outcome per element to the breaker, stopping at
+// the first rejected request. It returns the number of requests let through.
+func outcomes(cb *CircuitBreaker, successes ...bool) int {
+	for i, success := range successes {
+		call, err := cb.allow()
+		if err != nil {
+			return i
+		}
+		call.done(success)
+	}
+	return len(successes)
+}
+
+func repeat(success bool, n int) []bool {
+	s := make([]bool, n)
+	for i := range s {
+		s[i] = success
+	}
+	return s
+}
+
+func TestCircuitBreakerStateMachine(t *testing.T) {
+	const openTimeout = 20 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		config  CircuitBreakerConfig
+		run     func(t *testing.T, cb *CircuitBreaker)
+		want    CircuitState
+		changes []CircuitState
+	}{
+		{
+			name:   "consecutive failures open the circuit",
+			config: CircuitBreakerConfig{ConsecutiveFailures: 3},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, repeat(false, 3)...)
+			},
+			want:    CircuitOpen,
+			changes: []CircuitState{CircuitOpen},
+		},
+		{
+			name:   "a success resets the consecutive failures",
+			config: CircuitBreakerConfig{ConsecutiveFailures: 3},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, false, false, true, false, false)
+			},
+			want: CircuitClosed,
+		},
+		{
+			name:   "error rate below the minimum requests keeps the circuit closed",
+			config: CircuitBreakerConfig{ErrorRate: 0.5, MinRequests: 10},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, repeat(false, 9)...)
+			},
+			want: CircuitClosed,
+		},
+		{
+			name:   "error rate opens the circuit",
+			config: CircuitBreakerConfig{ErrorRate: 0.5, MinRequests: 10},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, append(repeat(true, 5), repeat(false, 5)...)...)
+			},
+			want:    CircuitOpen,
+			changes: []CircuitState{CircuitOpen},
+		},
+		{
+			name:   "no trip settings default to an error rate",
+			config: CircuitBreakerConfig{MinRequests: 4},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, true, true, false, false)
+			},
+			want:    CircuitOpen,
+			changes: []CircuitState{CircuitOpen},
+		},
+		{
+			name:   "open circuit rejects requests",
+			config: CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Hour},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, false)
+				_, err := cb.allow()
+				var circuitErr *CircuitOpenError
+				if !errors.As(err, &circuitErr) || circuitErr.State != CircuitOpen {
+					t.Fatalf("expected a CircuitOpenError, got %v", err)
+				}
+			},
+			want:    CircuitOpen,
+			changes: []CircuitState{CircuitOpen},
+		},
+		{
+			name:   "successful probes close the circuit",
+			config: CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: openTimeout, HalfOpenRequests: 2},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, false)
+				time.Sleep(openTimeout)
+				if n := outcomes(cb, true, true); n != 2 {
+					t.Fatalf("%d probes let through, expected 2", n)
+				}
+			},
+			want:    CircuitClosed,
+			changes: []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed},
+		},
+		{
+			name:   "failed probe opens the circuit again",
+			config: CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: openTimeout},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, false)
+				time.Sleep(openTimeout)
+				outcomes(cb, false)
+			},
+			want:    CircuitOpen,
+			changes: []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen},
+		},
+		{
+			name:   "half-open circuit limits the probes",
+			config: CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: openTimeout},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, false)
+				time.Sleep(openTimeout)
+				if _, err := cb.allow(); err != nil {
+					t.Fatalf("unexpected error on the probe: %v", err)
+				}
+				if _, err := cb.allow(); err == nil {
+					t.Fatal("expected a second probe to be rejected")
+				}
+			},
+			want:    CircuitHalfOpen,
+			changes: []CircuitState{CircuitOpen, CircuitHalfOpen},
+		},
+		{
+			name:   "abandoned probe lets another one through",
+			config: CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: openTimeout},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, false)
+				time.Sleep(openTimeout)
+				call, err := cb.allow()
+				if err != nil {
+					t.Fatalf("unexpected error on the probe: %v", err)
+				}
+				call.abandon()
+				if n := outcomes(cb, true); n != 1 {
+					t.Fatal("expected a new probe to be let through")
+				}
+			},
+			want:    CircuitClosed,
+			changes: []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed},
+		},
+		{
+			name:   "outcomes of a previous state are ignored",
+			config: CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Hour},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				slow, _ := cb.allow()
+				outcomes(cb, false)
+				slow.done(true)
+			},
+			want:    CircuitOpen,
+			changes: []CircuitState{CircuitOpen},
+		},
+		{
+			name:   "window shorter than its buckets doesn't panic",
+			config: CircuitBreakerConfig{Window: time.Nanosecond, ErrorRate: 0.5, MinRequests: 1},
+			run: func(t *testing.T, cb *CircuitBreaker) {
+				outcomes(cb, false)
+			},
+			want:    CircuitOpen,
+			changes: []CircuitState{CircuitOpen},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changes []CircuitState
+			config := tt.config
+			config.OnStateChange = func(name string, from CircuitState, to CircuitState) {
+				changes = append(changes, to)
+			}
+
+			cb := NewCircuitBreaker("test", config)
+			tt.run(t, cb)
+
+			if state := cb.State(); state != tt.want {
+				t.Fatalf("state is %s, expected %s", state, tt.want)
+			}
+			if len(changes) != len(tt.changes) {
+				t.Fatalf("state changes are %v, expected %v", changes, tt.changes)
+			}
+			for i := range changes {
+				if changes[i] != tt.changes[i] {
+					t.Fatalf("state changes are %v, expected %v", changes, tt.changes)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerRequests(t *testing.T) {
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/client-error":
+			w.WriteHeader(http.StatusNotFound)
+		case "/cached":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("cached"))
+		case "/slow":
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer server.Close()
+
+	canceled := func(t *testing.T) []Option {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return []Option{Context(ctx)}
+	}
+	expired := func(t *testing.T) []Option {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		t.Cleanup(cancel)
+		return []Option{Context(ctx)}
+	}
+
+	tests := []struct {
+		name string
+		path string
+		opts func(t *testing.T) []Option
+		want CircuitState
+	}{
+		{name: "server errors open the circuit", path: "/fail", want: CircuitOpen},
+		{name: "client errors don't open the circuit", path: "/client-error", want: CircuitClosed},
+		{name: "canceled requests don't open the circuit", path: "/slow", opts: canceled, want: CircuitClosed},
+		{name: "expired requests don't open the circuit", path: "/slow", opts: expired, want: CircuitClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := NewCircuitBreaker(tt.name, CircuitBreakerConfig{ConsecutiveFailures: 3, OpenTimeout: time.Hour})
+			rb := &RequestBuilder{BaseURL: server.URL, Timeout: 5 * time.Second, CircuitBreaker: cb}
+
+			for i := 0; i < 3; i++ {
+				var opts []Option
+				if tt.opts != nil {
+					opts = tt.opts(t)
+				}
+				rb.Get(tt.path, opts...)
+			}
+
+			if state := cb.State(); state != tt.want {
+				t.Fatalf("state is %s, expected %s", state, tt.want)
+			}
+			if tt.want != CircuitOpen {
+				return
+			}
+
+			before := atomic.LoadInt64(&hits)
+			resp := rb.Get(tt.path)
+			var circuitErr *CircuitOpenError
+			if !errors.As(resp.Err, &circuitErr) {
+				t.Fatalf("expected a CircuitOpenError, got %v", resp.Err)
+			}
+			if atomic.LoadInt64(&hits) != before {
+				t.Fatal("the open circuit let a request through")
+			}
+		})
+	}
+
+	t.Run("open circuit still serves the cache", func(t *testing.T) {
+		cb := NewCircuitBreaker(t.Name(), CircuitBreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Hour})
+		rb := &RequestBuilder{BaseURL: server.URL, Timeout: 5 * time.Second, CircuitBreaker: cb, EnableCache: true}
+
+		if resp := rb.Get("/cached"); resp.Err != nil {
+			t.Fatalf("unexpected error: %v", resp.Err)
+		}
+		rb.Get("/fail")
+		if state := cb.State(); state != CircuitOpen {
+			t.Fatalf("state is %s, expected %s", state, CircuitOpen)
+		}
+
+		resp := rb.Get("/cached")
+		if resp.Err != nil || resp.String() != "cached" {
+			t.Fatalf("got %q, error %v, expected the cached response", resp.String(), resp.Err)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+
+	ugorji "github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec marshals request bodies and unmarshals response bodies of a
+// ContentType.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type registeredCodec struct {
+	codec     Codec
+	mimeTypes []string
+	accept    bool
+}
+
+var codecs = make(map[ContentType]registeredCodec)
+var mimeCodecs = make(map[string]Codec)
+var codecsMtx sync.RWMutex
+
+// RegisterCodec sets the Codec of a ContentType, which may be one of the
+// package constants or a new value defined by the caller.
+//
+// RequestBuilders with that ContentType marshal request bodies with the codec
+// and send the first of mimeTypes as Content-Type header, and as Accept header
+// unless the request has one. Response.FillUp unmarshals with the codec the
+// responses of any of mimeTypes. When several ContentTypes register the same
+// MIME type, FillUp uses the codec registered last.
+func RegisterCodec(contentType ContentType, codec Codec, mimeTypes ...string) {
+	registerCodec(contentType, codec, true, mimeTypes)
+}
+
+// registerCodec registers a codec whose first MIME type is only sent as
+// Accept header if accept is set.
+func registerCodec(contentType ContentType, codec Codec, accept bool, mimeTypes []string) {
+	if codec == nil || len(mimeTypes) == 0 {
+		panic("rest: RegisterCodec needs a codec and at least one MIME type")
+	}
+
+	codecsMtx.Lock()
+	codecs[contentType] = registeredCodec{codec, mimeTypes, accept}
+	for _, mimeType := range mimeTypes {
+		mimeCodecs[strings.ToLower(mimeType)] = codec
+	}
+	codecsMtx.Unlock()
+}
+
+func codecFor(contentType ContentType) (registeredCodec, bool) {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+
+	rc, ok := codecs[contentType]
+	return rc, ok
+}
+
+// codecForMIME returns the codec registered for the media type of a
+// Content-Type header value.
+func codecForMIME(contentType string) (Codec, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+
+	codec, ok := mimeCodecs[mediaType]
+	return codec, ok
+}
+
+func init() {
+	RegisterCodec(JSON, jsonCodec{}, "application/json")
+	RegisterCodec(XML, xmlCodec{}, "application/xml", "text/xml")
+	// Form posts are answered with other types, like JSON
+	registerCodec(FORM, formCodec{}, false, []string{"application/x-www-form-urlencoded"})
+	RegisterCodec(MSGPACK, msgpackCodec{}, "application/msgpack", "application/x-msgpack")
+	RegisterCodec(PROTOBUF, protobufCodec{}, "application/x-protobuf", "application/protobuf")
+	RegisterCodec(NDJSON, ndjsonCodec{}, "application/x-ndjson", "application/ndjson")
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type xmlCodec struct{}
+
+func (xmlCodec) Marshal(v interface{}) ([]byte, error)      { return xml.Marshal(v) }
+func (xmlCodec) Unmarshal(data []byte, v interface{}) error { return xml.Unmarshal(data, v) }
+
+// formCodec marshals url.Values, string maps and structs, using the `form`
+// tag of their fields as name. It unmarshals into url.Values and string maps.
+type formCodec struct{}
+
+func (formCodec) Marshal(v interface{}) ([]byte, error) {
+	values, err := formValues(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(values.Encode()), nil
+}
+
+func (formCodec) Unmarshal(data []byte, v interface{}) error {
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return err
+	}
+
+	switch fill := v.(type) {
+	case *url.Values:
+		*fill = values
+	case *map[string][]string:
+		*fill = values
+	case *map[string]string:
+		*fill = make(map[string]string, len(values))
+		for k := range values {
+			(*fill)[k] = values.Get(k)
+		}
+	default:
+		return fmt.Errorf("form: can't unmarshal into %T", v)
+	}
+	return nil
+}
+
+func formValues(v interface{}) (url.Values, error) {
+	switch body := v.(type) {
+	case url.Values:
+		return body, nil
+	case map[string][]string:
+		return body, nil
+	case map[string]string:
+		values := make(url.Values, len(body))
+		for k, value := range body {
+			values.Set(k, value)
+		}
+		return values, nil
+	case map[string]interface{}:
+		values := make(url.Values, len(body))
+		for k, value := range body {
+			values.Set(k, fmt.Sprint(value))
+		}
+		return values, nil
+	}
+
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("form: body is %T(%v) not a map or struct", v, v)
+	}
+
+	values := make(url.Values)
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name, opts := field.Tag.Get("form"), ""
+		if comma := strings.Index(name, ","); comma >= 0 {
+			name, opts = name[:comma], name[comma+1:]
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fv := rv.Field(i)
+		if opts == "omitempty" && fv.IsZero() {
+			continue
+		}
+
+		if fv.Kind() == reflect.Slice || fv.Kind() == reflect.Array {
+			for j := 0; j < fv.Len(); j++ {
+				values.Add(name, fmt.Sprint(fv.Index(j).Interface()))
+			}
+			continue
+		}
+		values.Set(name, fmt.Sprint(fv.Interface()))
+	}
+	return values, nil
+}
+
+var msgpackHandle = func() *ugorji.MsgpackHandle {
+	h := new(ugorji.MsgpackHandle)
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	h.RawToString = true
+	return h
+}()
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var b []byte
+	err := ugorji.NewEncoderBytes(&b, msgpackHandle).Encode(v)
+	return b, err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return ugorji.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: body is %T not a proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf: can't unmarshal into %T, not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// ndjsonCodec marshals each element of a slice as a JSON line, and
+// unmarshals each JSON line as an element appended to a slice.
+type ndjsonCodec struct{}
+
+func (ndjsonCodec) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		err := encoder.Encode(v)
+		return buffer.Bytes(), err
+	}
+
+	for i := 0; i < rv.Len(); i++ {
+		if err := encoder.Encode(rv.Index(i).Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func (ndjsonCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("ndjson: can't unmarshal into %T, not a pointer to a slice", v)
+	}
+
+	slice := rv.Elem()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		elem := reflect.New(slice.Type().Elem())
+		if err := decoder.Decode(elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return nil
+}
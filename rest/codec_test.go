@@ -0,0 +1,43 @@
+package rest
+
+import (
+	"testing"
+)
+
+// namedCodec is a JSON codec that can be told apart from the others.
+type namedCodec struct {
+	jsonCodec
+	name string
+}
+
+func TestCodecForMIMEPicksLastRegistration(t *testing.T) {
+	const mimeType = "application/vnd.rest-test+json"
+	first, second := ContentType(1001), ContentType(1002)
+
+	tests := []struct {
+		name     string
+		register ContentType
+		codec    string
+	}{
+		{name: "first registration", register: first, codec: "first"},
+		{name: "another ContentType with the same MIME type", register: second, codec: "second"},
+		{name: "registering the first one again", register: first, codec: "first again"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RegisterCodec(tt.register, namedCodec{name: tt.codec}, mimeType)
+
+			// The lookup is repeated since a map walk would pick at random
+			for i := 0; i < 100; i++ {
+				codec, ok := codecForMIME(mimeType + "; charset=utf-8")
+				if !ok {
+					t.Fatal("no codec for the MIME type")
+				}
+				if got := codec.(namedCodec).name; got != tt.codec {
+					t.Fatalf("got codec %q, expected %q", got, tt.codec)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultCompressMinSize is the minimum size of the request bodies compressed
+// when the RequestBuilder CompressMinSize is 0.
+var DefaultCompressMinSize = 1024
+
+// Content codings that can be uncompressed, in order of preference
+const acceptEncoding = "gzip, deflate, br"
+
+// compressBody gzips the body, if it is big enough.
+func (rb *RequestBuilder) compressBody(body reqBody) (reqBody, error) {
+	minSize := rb.CompressMinSize
+	if minSize <= 0 {
+		minSize = DefaultCompressMinSize
+	}
+	if body.multipart != nil || len(body.data) < minSize {
+		return body, nil
+	}
+
+	var buffer bytes.Buffer
+	gw := gzip.NewWriter(&buffer)
+	if _, err := gw.Write(body.data); err != nil {
+		return body, err
+	}
+	if err := gw.Close(); err != nil {
+		return body, err
+	}
+
+	body.data = buffer.Bytes()
+	body.encoding = "gzip"
+	return body, nil
+}
+
+// responseEncoding returns the content codings applied to the response body,
+// treating an application/x-gzip Content-Type as gzip encoded.
+func responseEncoding(resp *http.Response) string {
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding == "" && resp.Header.Get("Content-Type") == "application/x-gzip" {
+		encoding = "gzip"
+	}
+	return encoding
+}
+
+// supportedEncoding returns whether all the content codings of encoding can
+// be uncompressed.
+func supportedEncoding(encoding string) bool {
+	for _, coding := range strings.Split(encoding, ",") {
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "", "identity", "gzip", "x-gzip", "deflate", "br":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// uncompress returns a reader of the body without the content codings of
+// encoding, which are undone in reverse order.
+func uncompress(body io.Reader, encoding string) (io.Reader, error) {
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch coding := strings.ToLower(strings.TrimSpace(codings[i])); coding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = newDeflateReader(body)
+		case "br":
+			body = brotli.NewReader(body)
+		default:
+			err = fmt.Errorf("unsupported content encoding %q", coding)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// newDeflateReader reads zlib wrapped deflate data, as the HTTP deflate coding
+// is defined, falling back to raw deflate data sent by some servers.
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	// A zlib header uses the deflate method and is a multiple of 31
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// uncompressed marks the response as uncompressed, like the http.Transport
+// does with the responses it uncompresses.
+func uncompressed(resp *http.Response) {
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
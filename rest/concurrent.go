@@ -0,0 +1,103 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ForkJoinRequest is one of the requests issued by ForkJoin.
+type ForkJoinRequest struct {
+	Verb string
+	URL  string
+	Body interface{}
+
+	// Options of the request. A Context option is ignored, every request
+	// uses the ForkJoin context.
+	Options []Option
+}
+
+// ForkJoinConfig configures how ForkJoin issues its requests.
+type ForkJoinConfig struct {
+	// Parent context of all the requests
+	Context context.Context
+
+	// Maximum requests in flight at once, 0 means no limit
+	MaxConcurrency int
+
+	// Cancel the requests still pending as soon as one of them fails, either
+	// with an error or a 5xx status code
+	FailFast bool
+
+	// Deadline for the whole set of requests, 0 means no deadline
+	Timeout time.Duration
+}
+
+// ForkJoin issues the given requests in parallel, and returns their responses
+// in the same order once all of them are done.
+//
+// Requests that could not start, because of the deadline or a fail fast
+// cancellation, get a Response with the context error. A panic while issuing
+// a request is returned as the Response error instead of crashing.
+func (rb *RequestBuilder) ForkJoin(config ForkJoinConfig, requests ...ForkJoinRequest) []*Response {
+	ctx := config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var cancel context.CancelFunc
+	if config.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	limit := config.MaxConcurrency
+	if limit <= 0 || limit > len(requests) {
+		limit = len(requests)
+	}
+	sem := make(chan struct{}, limit)
+
+	responses := make([]*Response, len(requests))
+	var wg sync.WaitGroup
+
+	for i := range requests {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if err := ctx.Err(); err != nil {
+			responses[i] = &Response{Err: err}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			responses[i] = rb.forkJoinRequest(ctx, requests[i])
+			if config.FailFast && (responses[i].Err != nil || responses[i].StatusCode >= http.StatusInternalServerError) {
+				cancel()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	return responses
+}
+
+func (rb *RequestBuilder) forkJoinRequest(ctx context.Context, req ForkJoinRequest) (resp *Response) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp = &Response{Err: fmt.Errorf("panic issuing %s %s: %v", req.Verb, req.URL, r)}
+		}
+	}()
+
+	opts := append(append([]Option{}, req.Options...), Context(ctx))
+	return rb.DoRequest(req.Verb, req.URL, req.Body, opts...)
+}
@@ -0,0 +1,379 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/matiasnu/go-jopit-toolkit/goutils/logger"
+)
+
+// DefaultRedactedHeaders are the headers always masked in debug logs, dumps
+// and curl commands.
+var DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// DefaultRedactedParams are the query params, and fields of JSON and form
+// bodies, always masked in debug logs, dumps and curl commands. Query params
+// named like a redacted header are masked too.
+var DefaultRedactedParams = []string{
+	"access_token", "refresh_token", "id_token", "token", "client_secret", "password",
+	"api_key", "apikey", "key", "sig", "signature",
+	"X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token",
+}
+
+// DefaultDebugBodySize is the maximum bytes of each body logged in debug
+// mode when the DebugConfig MaxBodySize is 0.
+var DefaultDebugBodySize = 2048
+
+const redactedValue = "[REDACTED]"
+
+// DebugConfig configures the debug mode of a RequestBuilder, which logs every
+// attempt of its requests, with their responses, through goutils/logger.
+type DebugConfig struct {
+	// Headers masked besides DefaultRedactedHeaders
+	RedactHeaders []string
+
+	// Fields of JSON and form bodies, at any depth, and query params masked
+	// besides DefaultRedactedParams
+	RedactFields []string
+
+	// Maximum bytes of each body logged, DefaultDebugBodySize if 0. A negative
+	// value logs the whole bodies.
+	MaxBodySize int
+}
+
+// redactor masks the secrets of requests and responses.
+type redactor struct {
+	headers map[string]bool
+	fields  map[string]bool
+	params  map[string]bool
+}
+
+var defaultRedactor = newRedactor(nil)
+
+func newRedactor(config *DebugConfig) *redactor {
+	r := &redactor{headers: make(map[string]bool), fields: make(map[string]bool), params: make(map[string]bool)}
+
+	headers := DefaultRedactedHeaders
+	if config != nil {
+		headers = append(append([]string{}, headers...), config.RedactHeaders...)
+		for _, field := range config.RedactFields {
+			r.fields[strings.ToLower(field)] = true
+			r.params[strings.ToLower(field)] = true
+		}
+	}
+
+	// Query params named like a secret header, like X-Api-Key, are secret too
+	for _, header := range headers {
+		r.headers[http.CanonicalHeaderKey(header)] = true
+		r.params[strings.ToLower(header)] = true
+	}
+	for _, param := range DefaultRedactedParams {
+		r.fields[strings.ToLower(param)] = true
+		r.params[strings.ToLower(param)] = true
+	}
+	return r
+}
+
+func (rb *RequestBuilder) getRedactor() *redactor {
+	rb.redactorMtxOnce.Do(func() {
+		rb.redactor = newRedactor(rb.Debug)
+	})
+	return rb.redactor
+}
+
+// header returns a copy of the header with the secret values masked.
+func (r *redactor) header(header http.Header) http.Header {
+	masked := header.Clone()
+	for key, values := range masked {
+		if r.headers[http.CanonicalHeaderKey(key)] {
+			for i := range values {
+				values[i] = redactedValue
+			}
+		}
+	}
+	return masked
+}
+
+// url returns the URL with its password and secret query params masked.
+func (r *redactor) url(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Redacted()
+	}
+
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		key := param
+		if j := strings.IndexByte(param, '='); j >= 0 {
+			key = param[:j]
+		}
+		if name, err := url.QueryUnescape(key); err == nil && r.params[strings.ToLower(name)] {
+			params[i] = key + "=" + redactedValue
+		}
+	}
+
+	masked := *u
+	masked.RawQuery = strings.Join(params, "&")
+	return masked.Redacted()
+}
+
+// body returns the body with the secret fields masked, if it is JSON or a
+// form.
+func (r *redactor) body(body []byte, contentType string) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return body
+		}
+		for key, vs := range values {
+			if r.fields[strings.ToLower(key)] {
+				for i := range vs {
+					vs[i] = redactedValue
+				}
+			}
+		}
+		return []byte(values.Encode())
+
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return body
+		}
+		masked, err := json.Marshal(r.value(v))
+		if err != nil {
+			return body
+		}
+		return masked
+	}
+	return body
+}
+
+func (r *redactor) value(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if r.fields[strings.ToLower(key)] {
+				value[key] = redactedValue
+			} else {
+				value[key] = r.value(field)
+			}
+		}
+	case []interface{}:
+		for i, elem := range value {
+			value[i] = r.value(elem)
+		}
+	}
+	return v
+}
+
+// requestBody returns a copy of the body of the request, if it can be read
+// again.
+func requestBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	return data, err == nil
+}
+
+// debugLog returns a handler that logs each attempt sent with next.
+func (rb *RequestBuilder) debugLog(next Handler) Handler {
+	return func(req *http.Request) *Response {
+		start := time.Now()
+		result := next(req)
+
+		if logger.Log != nil {
+			dump := rb.getRedactor().dump(req, result, rb.debugBodySize())
+			logger.Debug(fmt.Sprintf("rest debug [elapsed:%s]\n%s", time.Since(start), dump), "pool:"+rb.poolName)
+		}
+		return result
+	}
+}
+
+func (rb *RequestBuilder) debugBodySize() int {
+	if rb.Debug.MaxBodySize == 0 {
+		return DefaultDebugBodySize
+	}
+	return rb.Debug.MaxBodySize
+}
+
+// dump returns the request and its response, with their secrets masked and
+// their bodies truncated to maxBody bytes, if positive.
+func (r *redactor) dump(req *http.Request, resp *Response, maxBody int) string {
+	const separator = "--------\n"
+
+	var dump strings.Builder
+	dump.WriteString(separator + "REQUEST\n" + separator)
+	if req != nil {
+		fmt.Fprintf(&dump, "%s %s %s\n", req.Method, r.url(req.URL), req.Proto)
+		r.header(req.Header).Write(&dump)
+		dump.WriteString("\n")
+
+		if body, ok := requestBody(req); ok {
+			dump.Write(r.dumpBody(body, req.Header, maxBody, true))
+		} else {
+			dump.WriteString("[streamed body]")
+		}
+		dump.WriteString("\n")
+	}
+
+	dump.WriteString(separator + "RESPONSE\n" + separator)
+	switch {
+	case resp == nil:
+	case resp.Response == nil:
+		err := resp.Err
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) && req != nil {
+			err = &url.Error{Op: urlErr.Op, URL: r.url(req.URL), Err: urlErr.Err}
+		}
+		fmt.Fprintf(&dump, "ERROR: %v\n", err)
+	default:
+		fmt.Fprintf(&dump, "%s %s\n", resp.Proto, resp.Status)
+		r.header(resp.Header).Write(&dump)
+		dump.WriteString("\n")
+		if resp.stream != nil {
+			dump.WriteString("[streamed body]")
+		} else {
+			dump.Write(r.dumpBody(resp.byteBody, resp.Header, maxBody, false))
+		}
+		dump.WriteString("\n")
+	}
+
+	return dump.String()
+}
+
+// dumpBody returns the body as dumped, with its secret fields masked. Encoded
+// bodies are uncompressed if uncompress is set, the request ones we
+// compressed ourselves, and elided otherwise.
+func (r *redactor) dumpBody(body []byte, header http.Header, maxBody int, uncompress bool) []byte {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && len(body) > 0 {
+		elided := []byte(fmt.Sprintf("[%s encoded body of %d bytes]", encoding, len(body)))
+		if !uncompress {
+			return elided
+		}
+
+		decoded, err := uncompressBody(body, encoding)
+		if err != nil {
+			return elided
+		}
+		body = decoded
+	}
+	return truncate(r.body(body, header.Get("Content-Type")), maxBody)
+}
+
+func uncompressBody(body []byte, encoding string) ([]byte, error) {
+	if !supportedEncoding(encoding) {
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	reader, err := uncompress(bytes.NewReader(body), encoding)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func truncate(body []byte, max int) []byte {
+	if max <= 0 || len(body) <= max {
+		return body
+	}
+	return append(body[:max:max], []byte(fmt.Sprintf("... [%d bytes truncated]", len(body)-max))...)
+}
+
+// Curl returns a curl command that reproduces the request of the response,
+// with its secrets masked.
+func (r *Response) Curl() string {
+	req := r.sentRequest()
+	if req == nil {
+		return ""
+	}
+
+	redactor := r.redactor
+	if redactor == nil {
+		redactor = defaultRedactor
+	}
+
+	var command strings.Builder
+	command.WriteString("curl")
+	if req.Method != http.MethodGet {
+		command.WriteString(" -X " + shellQuote(req.Method))
+	}
+	command.WriteString(" " + shellQuote(redactor.url(req.URL)))
+
+	header := redactor.header(req.Header)
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			command.WriteString(" \\\n  -H " + shellQuote(key+": "+value))
+		}
+	}
+
+	body, ok := requestBody(req)
+	switch {
+	case !ok:
+		command.WriteString(" \\\n  # streamed body not available")
+	case len(body) == 0:
+	case !utf8.Valid(body) || req.Header.Get("Content-Encoding") != "":
+		fmt.Fprintf(&command, " \\\n  # binary body of %d bytes not included", len(body))
+	default:
+		body = redactor.body(body, req.Header.Get("Content-Type"))
+		command.WriteString(" \\\n  --data-binary " + shellQuote(string(body)))
+	}
+
+	return command.String()
+}
+
+// sentRequest returns the last request sent to get the response.
+func (r *Response) sentRequest() *http.Request {
+	if r.request != nil {
+		return r.request
+	}
+	if r.Response != nil {
+		return r.Request
+	}
+	return nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Debug returns a dump of the request and its response, showing how they
+// went through the wire, with the secret headers and fields masked. The
+// DebugConfig of the RequestBuilder adds its redactions, and logs these dumps
+// for every request.
+func (r *Response) Debug() string {
+	redactor := r.redactor
+	if redactor == nil {
+		redactor = defaultRedactor
+	}
+	return redactor.dump(r.sentRequest(), r, 0)
+}
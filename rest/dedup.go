@@ -0,0 +1,115 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// DedupConfig configures the deduplication of identical GET requests in
+// flight, which are collapsed into a single request. Every caller gets its
+// own copy of the Response.
+type DedupConfig struct {
+	// Request headers that are part of the key besides method, URL and the
+	// credentials of the request, Authorization and Cookie
+	Headers []string
+
+	// Optional function that returns the key of a request, replacing the
+	// default one. Requests with the same key are collapsed.
+	Key func(req *http.Request) string
+}
+
+type flight struct {
+	done   chan struct{}
+	result *Response
+}
+
+// Headers always part of the key, so that requests of different principals
+// are never collapsed
+var credentialHeaders = []string{"Authorization", "Cookie"}
+
+func (c *DedupConfig) key(req *http.Request) string {
+	if c.Key != nil {
+		return c.Key(req)
+	}
+
+	var key strings.Builder
+	key.WriteString(req.Method)
+	key.WriteString(" ")
+	key.WriteString(req.URL.String())
+	for _, header := range append(credentialHeaders, c.Headers...) {
+		key.WriteString("\n")
+		key.WriteString(http.CanonicalHeaderKey(header))
+		key.WriteString(": ")
+		key.WriteString(strings.Join(req.Header.Values(header), ","))
+	}
+	return key.String()
+}
+
+// dedup returns a handler that sends the request with next, unless an
+// identical one is already in flight, whose response is then shared.
+func (rb *RequestBuilder) dedup(next Handler) Handler {
+	return func(req *http.Request) *Response {
+		if req.Method != http.MethodGet {
+			return next(req)
+		}
+
+		key := rb.Dedup.key(req)
+
+		rb.flightsMtx.Lock()
+		if f, ok := rb.flights[key]; ok {
+			rb.flightsMtx.Unlock()
+			return rb.follow(f, req, next)
+		}
+
+		f := &flight{done: make(chan struct{})}
+		if rb.flights == nil {
+			rb.flights = make(map[string]*flight)
+		}
+		rb.flights[key] = f
+		rb.flightsMtx.Unlock()
+
+		f.result = next(req)
+
+		rb.flightsMtx.Lock()
+		delete(rb.flights, key)
+		rb.flightsMtx.Unlock()
+		close(f.done)
+
+		// The shared response is kept untouched, every caller gets a copy
+		return f.result.clone(req)
+	}
+}
+
+// follow waits for the response of the flight. If the flight request failed
+// because its context was canceled or expired, it sends its own request
+// instead.
+func (rb *RequestBuilder) follow(f *flight, req *http.Request, next Handler) *Response {
+	select {
+	case <-f.done:
+	case <-req.Context().Done():
+		return &Response{Err: req.Context().Err()}
+	}
+
+	canceled := errors.Is(f.result.Err, context.Canceled) || errors.Is(f.result.Err, context.DeadlineExceeded)
+	if canceled && req.Context().Err() == nil {
+		return next(req)
+	}
+	return f.result.clone(req)
+}
+
+// clone returns a copy of the response, for the given request.
+func (r *Response) clone(req *http.Request) *Response {
+	c := &Response{Err: r.Err}
+	if r.Response != nil {
+		resp := *r.Response
+		resp.Header = r.Header.Clone()
+		resp.Request = req
+		c.Response = &resp
+	}
+	if r.byteBody != nil {
+		c.byteBody = append([]byte(nil), r.byteBody...)
+	}
+	return c
+}
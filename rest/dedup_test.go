@@ -0,0 +1,221 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingServer holds the first request until release is closed, and
+// answers the others right away. Every response echoes the credentials of
+// its request.
+type blockingServer struct {
+	*httptest.Server
+	hits    int64
+	release chan struct{}
+}
+
+func newBlockingServer(t *testing.T) *blockingServer {
+	t.Helper()
+
+	s := &blockingServer{release: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&s.hits, 1) == 1 {
+			select {
+			case <-s.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte(r.Header.Get("Authorization") + "|" + r.Header.Get("Cookie")))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *blockingServer) waitHits(t *testing.T, n int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&s.hits) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("server got %d requests, expected %d", atomic.LoadInt64(&s.hits), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func cookie(value string) Option {
+	return Headers(http.Header{"Cookie": {value}})
+}
+
+func TestDedupKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		leader   []Option
+		follower []Option
+		wantHits int64
+	}{
+		{
+			name:     "same request is collapsed",
+			wantHits: 1,
+		},
+		{
+			name:     "same bearer token is collapsed",
+			leader:   []Option{BearerToken("alice")},
+			follower: []Option{BearerToken("alice")},
+			wantHits: 1,
+		},
+		{
+			name:     "different bearer tokens are not collapsed",
+			leader:   []Option{BearerToken("alice")},
+			follower: []Option{BearerToken("bob")},
+			wantHits: 2,
+		},
+		{
+			name:     "different basic auth is not collapsed",
+			leader:   []Option{Credentials("alice", "secret")},
+			follower: []Option{Credentials("bob", "secret")},
+			wantHits: 2,
+		},
+		{
+			name:     "different cookies are not collapsed",
+			leader:   []Option{cookie("session=alice")},
+			follower: []Option{cookie("session=bob")},
+			wantHits: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newBlockingServer(t)
+			rb := &RequestBuilder{BaseURL: server.URL, Timeout: 5 * time.Second, Dedup: &DedupConfig{}}
+
+			leader := make(chan *Response, 1)
+			go func() { leader <- rb.Get("/resource", tt.leader...) }()
+			server.waitHits(t, 1)
+
+			follower := make(chan *Response, 1)
+			go func() { follower <- rb.Get("/resource", tt.follower...) }()
+
+			if tt.wantHits > 1 {
+				server.waitHits(t, tt.wantHits)
+			} else {
+				time.Sleep(50 * time.Millisecond)
+			}
+			close(server.release)
+
+			leaderResp, followerResp := <-leader, <-follower
+			if leaderResp.Err != nil || followerResp.Err != nil {
+				t.Fatalf("unexpected errors: %v, %v", leaderResp.Err, followerResp.Err)
+			}
+			if hits := atomic.LoadInt64(&server.hits); hits != tt.wantHits {
+				t.Fatalf("server got %d requests, expected %d", hits, tt.wantHits)
+			}
+
+			// Every caller must see the response to its own credentials
+			for _, resp := range []*Response{leaderResp, followerResp} {
+				if got, want := resp.String(), resp.request.Header.Get("Authorization")+"|"+resp.request.Header.Get("Cookie"); got != want {
+					t.Fatalf("got response %q for the credentials %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupFollowerResendsWhenLeaderContextEnds(t *testing.T) {
+	tests := []struct {
+		name   string
+		leader func() (context.Context, context.CancelFunc)
+		cancel bool
+	}{
+		{
+			name: "leader canceled",
+			leader: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+			cancel: true,
+		},
+		{
+			name: "leader deadline exceeded",
+			leader: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 100*time.Millisecond)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newBlockingServer(t)
+			defer close(server.release)
+			rb := &RequestBuilder{BaseURL: server.URL, Timeout: 5 * time.Second, Dedup: &DedupConfig{}}
+
+			ctx, cancel := tt.leader()
+			defer cancel()
+
+			leader := make(chan *Response, 1)
+			go func() { leader <- rb.Get("/resource", Context(ctx)) }()
+			server.waitHits(t, 1)
+
+			follower := make(chan *Response, 1)
+			go func() { follower <- rb.Get("/resource") }()
+			time.Sleep(50 * time.Millisecond)
+			if tt.cancel {
+				cancel()
+			}
+
+			if resp := <-leader; resp.Err == nil {
+				t.Fatal("expected the leader to fail")
+			}
+
+			resp := <-follower
+			if resp.Err != nil {
+				t.Fatalf("unexpected follower error: %v", resp.Err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected follower status %d", resp.StatusCode)
+			}
+			if hits := atomic.LoadInt64(&server.hits); hits != 2 {
+				t.Fatalf("server got %d requests, expected 2", hits)
+			}
+		})
+	}
+}
+
+func TestDedupSharesResponseWhenLeaderContextEndsAfterIt(t *testing.T) {
+	const followers = 20
+
+	server := newBlockingServer(t)
+	rb := &RequestBuilder{BaseURL: server.URL, Timeout: 5 * time.Second, Dedup: &DedupConfig{}}
+
+	// The usual caller cancels its context as soon as it gets the response
+	leader := make(chan *Response, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		leader <- rb.Get("/resource", Context(ctx))
+	}()
+	server.waitHits(t, 1)
+
+	responses := make(chan *Response, followers)
+	for i := 0; i < followers; i++ {
+		go func() { responses <- rb.Get("/resource") }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(server.release)
+
+	if resp := <-leader; resp.Err != nil {
+		t.Fatalf("unexpected leader error: %v", resp.Err)
+	}
+	for i := 0; i < followers; i++ {
+		if resp := <-responses; resp.Err != nil {
+			t.Fatalf("unexpected follower error: %v", resp.Err)
+		}
+	}
+	if hits := atomic.LoadInt64(&server.hits); hits != 1 {
+		t.Fatalf("server got %d requests, expected 1", hits)
+	}
+}
@@ -0,0 +1,250 @@
+package rest
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const HEDGE_HEADER = "X-Hedge"
+
+// Number of latencies kept to compute the hedging delay
+const hedgingSamples = 256
+
+// HedgingConfig configures a HedgingPolicy. Zero values take the defaults
+// described on each field.
+type HedgingConfig struct {
+	// Percentile, from 0 to 100, of the observed latencies after which a new
+	// attempt is sent. 0 means always waiting Delay.
+	Percentile float64
+
+	// Delay before a new attempt while there are not enough observed
+	// latencies, and minimum delay afterwards. 50ms by default
+	Delay time.Duration
+
+	// Maximum attempts sent besides the original one, 1 by default
+	MaxHedges int
+
+	// Verbs to hedge, GET, HEAD and OPTIONS by default. Only idempotent
+	// verbs should be hedged.
+	Methods []string
+}
+
+// HedgingPolicy sends extra identical attempts of a slow request, keeping the
+// first successful response and canceling the others. Hedged attempts carry
+// the HEDGE_HEADER with their number.
+//
+// It can be shared by several RequestBuilders, which then share the latencies
+// used to compute the delay.
+type HedgingPolicy struct {
+	config HedgingConfig
+
+	mtx       sync.Mutex
+	latencies [hedgingSamples]time.Duration
+	samples   int
+	next      int
+}
+
+// NewHedgingPolicy returns a HedgingPolicy with the given config.
+func NewHedgingPolicy(config HedgingConfig) *HedgingPolicy {
+	if config.Delay <= 0 {
+		config.Delay = 50 * time.Millisecond
+	}
+	if config.MaxHedges <= 0 {
+		config.MaxHedges = 1
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	return &HedgingPolicy{config: config}
+}
+
+// Delay returns the time to wait before sending a new attempt.
+func (h *HedgingPolicy) Delay() time.Duration {
+	if h.config.Percentile <= 0 {
+		return h.config.Delay
+	}
+
+	h.mtx.Lock()
+	if h.samples < hedgingSamples/4 {
+		h.mtx.Unlock()
+		return h.config.Delay
+	}
+	latencies := make([]time.Duration, h.samples)
+	copy(latencies, h.latencies[:h.samples])
+	h.mtx.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	index := int(math.Ceil(h.config.Percentile/100*float64(len(latencies)))) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(latencies) {
+		index = len(latencies) - 1
+	}
+
+	if delay := latencies[index]; delay > h.config.Delay {
+		return delay
+	}
+	return h.config.Delay
+}
+
+func (h *HedgingPolicy) observe(latency time.Duration) {
+	h.mtx.Lock()
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % hedgingSamples
+	if h.samples < hedgingSamples {
+		h.samples++
+	}
+	h.mtx.Unlock()
+}
+
+func (h *HedgingPolicy) applies(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	for _, method := range h.config.Methods {
+		if method == req.Method {
+			return true
+		}
+	}
+	return false
+}
+
+type hedgedResult struct {
+	attempt int
+	result  *Response
+}
+
+// hedge returns a handler that sends the request with next, hedging it when
+// the policy applies.
+func (h *HedgingPolicy) hedge(next Handler) Handler {
+	return func(req *http.Request) *Response {
+		if !h.applies(req) {
+			return next(req)
+		}
+
+		results := make(chan hedgedResult, h.config.MaxHedges+1)
+		cancels := make([]context.CancelFunc, 0, h.config.MaxHedges+1)
+
+		// Each hedged attempt goes to an endpoint the others don't use
+		balanced := balancedRequestOf(req)
+		var used []*endpoint
+		if balanced != nil {
+			used = append(used, balanced.ep)
+			balanced.hedged = true
+		}
+
+		launch := func() {
+			attempt := len(cancels)
+			ctx, cancel := context.WithCancel(req.Context())
+			cancels = append(cancels, cancel)
+
+			hedged := req.Clone(ctx)
+			var ep *endpoint
+			if attempt > 0 {
+				hedged.Header.Set(HEDGE_HEADER, strconv.Itoa(attempt))
+				if req.GetBody != nil {
+					hedged.Body, _ = req.GetBody()
+				}
+				if balanced != nil {
+					if ep = balanced.retarget(hedged, used); ep != nil {
+						used = append(used, ep)
+					}
+				}
+			}
+
+			go func() {
+				start := time.Now()
+				result := next(hedged)
+				if isSuccess(result) {
+					h.observe(time.Since(start))
+				}
+				// Each attempt counts for its own endpoint, not the winner's
+				if ep != nil {
+					balanced.done(ep, hedged, result)
+				} else if attempt == 0 && balanced != nil {
+					balanced.record(balanced.ep, hedged, result)
+				}
+				results <- hedgedResult{attempt, result}
+			}()
+		}
+
+		launch()
+		timer := time.NewTimer(h.Delay())
+		defer timer.Stop()
+
+		var last hedgedResult
+		for pending := 1; pending > 0; {
+			select {
+			case r := <-results:
+				pending--
+				if isSuccess(r.result) {
+					h.discardOthers(r.attempt, cancels, results, pending)
+					cancelAfterBody(r.result, cancels[r.attempt])
+					return r.result
+				}
+				if last.result != nil {
+					last.result.discard()
+					cancels[last.attempt]()
+				}
+				last = r
+			case <-timer.C:
+				if len(cancels) <= h.config.MaxHedges {
+					launch()
+					pending++
+					timer.Reset(h.Delay())
+				}
+			}
+		}
+
+		cancelAfterBody(last.result, cancels[last.attempt])
+		return last.result
+	}
+}
+
+// cancelAfterBody cancels the context of the attempt of a response once its
+// body is consumed, which is right away unless it is streamed.
+func cancelAfterBody(result *Response, cancel context.CancelFunc) {
+	if result.stream == nil {
+		cancel()
+		return
+	}
+	result.stream = &canceledBody{ReadCloser: result.stream, cancel: cancel}
+}
+
+// canceledBody cancels the context of its request once closed.
+type canceledBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *canceledBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// discardOthers cancels the attempts that lost, and releases their responses
+// once they finish.
+func (h *HedgingPolicy) discardOthers(winner int, cancels []context.CancelFunc, results chan hedgedResult, pending int) {
+	for attempt, cancel := range cancels {
+		if attempt != winner {
+			cancel()
+		}
+	}
+
+	go func() {
+		for ; pending > 0; pending-- {
+			(<-results).result.discard()
+		}
+	}()
+}
+
+func isSuccess(result *Response) bool {
+	return result.Err == nil && result.StatusCode < http.StatusInternalServerError
+}
@@ -0,0 +1,204 @@
+package rest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hedgingServer answers the original attempts after primaryDelay with
+// primaryStatus, and the hedged ones after hedgeDelay with hedgeStatus.
+type hedgingServer struct {
+	*httptest.Server
+	hits   int64
+	hedges int64
+}
+
+func newHedgingServer(t *testing.T, name string, primaryDelay time.Duration, primaryStatus int, hedgeDelay time.Duration, hedgeStatus int) *hedgingServer {
+	t.Helper()
+
+	s := &hedgingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.hits, 1)
+		attempt, delay, status := "primary", primaryDelay, primaryStatus
+		if r.Header.Get(HEDGE_HEADER) != "" {
+			atomic.AddInt64(&s.hedges, 1)
+			attempt, delay, status = "hedge", hedgeDelay, hedgeStatus
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(name + " " + attempt))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestHedging(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryDelay  time.Duration
+		primaryStatus int
+		hedgeStatus   int
+		wantStatus    int
+		wantBody      string
+		wantHits      int64
+	}{
+		{
+			name:          "fast primary is not hedged",
+			primaryStatus: http.StatusOK,
+			hedgeStatus:   http.StatusOK,
+			wantStatus:    http.StatusOK,
+			wantBody:      "server primary",
+			wantHits:      1,
+		},
+		{
+			name:          "slow primary loses to the hedge",
+			primaryDelay:  time.Second,
+			primaryStatus: http.StatusOK,
+			hedgeStatus:   http.StatusOK,
+			wantStatus:    http.StatusOK,
+			wantBody:      "server hedge",
+			wantHits:      2,
+		},
+		{
+			name:          "failed hedge waits for the primary",
+			primaryDelay:  100 * time.Millisecond,
+			primaryStatus: http.StatusOK,
+			hedgeStatus:   http.StatusServiceUnavailable,
+			wantStatus:    http.StatusOK,
+			wantBody:      "server primary",
+			wantHits:      2,
+		},
+		{
+			name:          "every attempt failing returns the last failure",
+			primaryDelay:  100 * time.Millisecond,
+			primaryStatus: http.StatusBadGateway,
+			hedgeStatus:   http.StatusServiceUnavailable,
+			wantStatus:    http.StatusBadGateway,
+			wantBody:      "server primary",
+			wantHits:      2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newHedgingServer(t, "server", tt.primaryDelay, tt.primaryStatus, 0, tt.hedgeStatus)
+			rb := &RequestBuilder{
+				BaseURL: server.URL,
+				Timeout: 5 * time.Second,
+				Hedging: NewHedgingPolicy(HedgingConfig{Delay: 20 * time.Millisecond}),
+			}
+
+			resp := rb.Get("/resource")
+			if resp.Err != nil {
+				t.Fatalf("unexpected error: %v", resp.Err)
+			}
+			if resp.StatusCode != tt.wantStatus || resp.String() != tt.wantBody {
+				t.Fatalf("got %d %q, expected %d %q", resp.StatusCode, resp.String(), tt.wantStatus, tt.wantBody)
+			}
+			if hits := atomic.LoadInt64(&server.hits); hits != tt.wantHits {
+				t.Fatalf("server got %d requests, expected %d", hits, tt.wantHits)
+			}
+
+			// The context of the returned attempt is released with its body
+			if err := resp.Request.Context().Err(); err == nil {
+				t.Fatal("the context of the returned attempt was not canceled")
+			}
+		})
+	}
+}
+
+func TestHedgingStreamKeepsContextUntilClose(t *testing.T) {
+	server := newHedgingServer(t, "server", time.Second, http.StatusOK, 0, http.StatusOK)
+	rb := &RequestBuilder{
+		BaseURL: server.URL,
+		Timeout: 5 * time.Second,
+		Hedging: NewHedgingPolicy(HedgingConfig{Delay: 20 * time.Millisecond}),
+	}
+
+	resp := rb.Get("/resource", Stream())
+	if resp.Err != nil {
+		t.Fatalf("unexpected error: %v", resp.Err)
+	}
+
+	ctx := resp.Request.Context()
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("the context of a streamed attempt ended before reading it: %v", err)
+	}
+
+	body := resp.Reader()
+	data, err := ioutil.ReadAll(body)
+	if err != nil || string(data) != "server hedge" {
+		t.Fatalf("got body %q, error %v", data, err)
+	}
+	body.Close()
+
+	if ctx.Err() == nil {
+		t.Fatal("the context of the streamed attempt was not canceled on close")
+	}
+}
+
+func TestHedgingPicksAnotherEndpoint(t *testing.T) {
+	slow := newHedgingServer(t, "slow", time.Second, http.StatusOK, 0, http.StatusOK)
+	fast := newHedgingServer(t, "fast", 0, http.StatusOK, 0, http.StatusOK)
+
+	lb := NewLoadBalancer([]string{slow.URL, fast.URL}, LoadBalancerConfig{Policy: RoundRobin})
+	rb := &RequestBuilder{
+		LoadBalancer: lb,
+		Timeout:      5 * time.Second,
+		Hedging:      NewHedgingPolicy(HedgingConfig{Delay: 20 * time.Millisecond}),
+	}
+
+	// Round robin sends the first request to the slow endpoint
+	resp := rb.Get("/resource")
+	if resp.Err != nil {
+		t.Fatalf("unexpected error: %v", resp.Err)
+	}
+	if resp.String() != "fast hedge" {
+		t.Fatalf("got %q, expected the hedge of the fast endpoint", resp.String())
+	}
+	if hedges := atomic.LoadInt64(&slow.hedges); hedges != 0 {
+		t.Fatalf("the slow endpoint got %d hedged attempts", hedges)
+	}
+
+	for _, status := range lb.Endpoints() {
+		if status.Outstanding != 0 || status.Ejected {
+			t.Fatalf("unexpected endpoint status %+v", status)
+		}
+	}
+}
+
+func TestHedgingRecordsEachAttemptForItsEndpoint(t *testing.T) {
+	// The original attempt fails while the hedged one is still in flight
+	failing := newHedgingServer(t, "failing", 50*time.Millisecond, http.StatusServiceUnavailable, 0, http.StatusOK)
+	healthy := newHedgingServer(t, "healthy", 0, http.StatusOK, 150*time.Millisecond, http.StatusOK)
+
+	lb := NewLoadBalancer([]string{failing.URL, healthy.URL}, LoadBalancerConfig{Policy: RoundRobin, MaxFailures: 1, EjectionTime: time.Hour})
+	rb := &RequestBuilder{
+		LoadBalancer: lb,
+		Timeout:      5 * time.Second,
+		Hedging:      NewHedgingPolicy(HedgingConfig{Delay: 20 * time.Millisecond}),
+	}
+
+	resp := rb.Get("/resource")
+	if resp.Err != nil || resp.String() != "healthy hedge" {
+		t.Fatalf("got %q, error %v, expected the hedge of the healthy endpoint", resp.String(), resp.Err)
+	}
+
+	for _, status := range lb.Endpoints() {
+		if status.Outstanding != 0 {
+			t.Fatalf("unexpected endpoint status %+v", status)
+		}
+		if failed := status.URL == failing.URL; status.Ejected != failed {
+			t.Fatalf("endpoint %s ejected: %t, expected %t", status.URL, status.Ejected, failed)
+		}
+	}
+}
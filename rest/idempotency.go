@@ -0,0 +1,34 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/gofrs/uuid"
+)
+
+const IDEMPOTENCY_HEADER = "Idempotency-Key"
+
+// Verbs that get a generated idempotency key
+var idempotencyKeyVerbs = map[string]struct{}{
+	http.MethodPost:  struct{}{},
+	http.MethodPatch: struct{}{},
+}
+
+// idempotencyKey returns the key sent on every attempt of a request: the one
+// given by the caller, or a new one for POST and PATCH requests if the
+// RequestBuilder IdempotencyKeys is set.
+func (rb *RequestBuilder) idempotencyKey(verb string, opt reqOptions) (string, error) {
+	if opt.idempotencyKey != "" {
+		return opt.idempotencyKey, nil
+	}
+
+	if _, ok := idempotencyKeyVerbs[verb]; !ok || !rb.IdempotencyKeys {
+		return "", nil
+	}
+
+	key, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
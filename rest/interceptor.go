@@ -0,0 +1,73 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Handler issues a request and returns its response.
+type Handler func(req *http.Request) *Response
+
+// Interceptor is a client side middleware, run on every attempt of the
+// requests of a RequestBuilder.
+//
+// It may modify the request before calling next, and inspect or replace the
+// Response next returns. Returning without calling next short-circuits the
+// request. A returned Response must have either its Err or its embedded
+// *http.Response set.
+type Interceptor func(req *http.Request, next Handler) *Response
+
+// chain returns the handler that runs the RequestBuilder interceptors, in
+// order, around the actual request.
+func (rb *RequestBuilder) chain(opt reqOptions) Handler {
+	handler := Handler(func(req *http.Request) *Response {
+		return rb.send(req, opt)
+	})
+
+	if rb.Debug != nil {
+		handler = rb.debugLog(handler)
+	}
+
+	// Every attempt sent takes its tokens, hedged ones included
+	if rb.RateLimiter != nil {
+		handler = rb.rateLimit(handler, opt.weight)
+	}
+
+	// Only the attempts that go to the network pass through the breaker
+	if cb := rb.getCircuitBreaker(); cb != nil {
+		handler = cb.intercept(handler)
+	}
+
+	if rb.Hedging != nil {
+		handler = rb.Hedging.hedge(handler)
+	}
+
+	// Streamed bodies can only be read by one caller
+	if rb.Dedup != nil && !opt.stream {
+		handler = rb.dedup(handler)
+	}
+
+	// The token is set first, so the interceptors see the final request
+	interceptors := rb.Interceptors
+	if rb.TokenSource != nil && opt.authorization == "" {
+		interceptors = append([]Interceptor{tokenInterceptor(rb.TokenSource)}, interceptors...)
+	}
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(req *http.Request) *Response {
+			return interceptor(req, next)
+		}
+	}
+
+	return func(req *http.Request) *Response {
+		result := handler(req)
+		if result == nil || (result.Err == nil && result.Response == nil) {
+			result = &Response{Err: errors.New("interceptor returned an empty response")}
+		}
+
+		result.request = req
+		result.redactor = rb.getRedactor()
+		return result
+	}
+}
@@ -0,0 +1,89 @@
+package rest
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/matiasnu/go-jopit-toolkit/rest/metrics"
+)
+
+// DefaultMetricsRecorder receives the metrics of every RequestBuilder that
+// doesn't set its own MetricsConfig.Recorder.
+var DefaultMetricsRecorder = metrics.NewMemoryRecorder()
+
+// initPoolName names the pool after the file that uses the RequestBuilder.
+// It must be called directly by DoRequest, for getCallerFile to skip the
+// right amount of frames, which are only walked until the name is set.
+func (rb *RequestBuilder) initPoolName() {
+	if atomic.LoadUint32(&rb.poolNameSet) == 1 {
+		return
+	}
+
+	name := getCallerFile()
+	rb.poolNameMtxOnce.Do(func() {
+		rb.poolName = name
+		atomic.StoreUint32(&rb.poolNameSet, 1)
+	})
+}
+
+func (rb *RequestBuilder) getMetricsRecorder() metrics.Recorder {
+	if rb.MetricsConfig.Recorder != nil {
+		return rb.MetricsConfig.Recorder
+	}
+	return DefaultMetricsRecorder
+}
+
+func (rb *RequestBuilder) metricsTags(req *http.Request) metrics.Tags {
+	target := rb.MetricsConfig.TargetId
+	if target == "" {
+		target = req.URL.Host
+	}
+	return metrics.Tags{Pool: rb.poolName, Target: target}
+}
+
+// traceConnections returns the request with a client trace that reports how
+// it obtains its connection.
+func (rb *RequestBuilder) traceConnections(req *http.Request, tags metrics.Tags) *http.Request {
+	if rb.MetricsConfig.DisableHttpConnectionsMetrics {
+		return req
+	}
+
+	recorder := rb.getMetricsRecorder()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				recorder.Connection(tags, metrics.ConnectionReused)
+			} else {
+				recorder.Connection(tags, metrics.ConnectionNew)
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				recorder.Connection(tags, metrics.ConnectionFailed)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				recorder.Connection(tags, metrics.ConnectionFailed)
+			}
+		},
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func (rb *RequestBuilder) recordApiCall(tags metrics.Tags, elapsed time.Duration, resp *http.Response, err error) {
+	if rb.MetricsConfig.DisableApiCallMetrics {
+		return
+	}
+
+	result := metrics.ResultError
+	if err == nil {
+		result = metrics.StatusClass(resp.StatusCode)
+	}
+
+	rb.getMetricsRecorder().ApiCall(tags, elapsed, result)
+}
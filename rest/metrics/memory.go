@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds of the latency histogram buckets.
+var DefaultBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// CallStats holds the api call metrics of a pool and target.
+type CallStats struct {
+	Tags Tags
+
+	// Calls per result ("2xx", "5xx", "error", ...)
+	Results map[string]uint64
+
+	// Latency histogram, Buckets[i] counts the calls that took up to
+	// Bounds[i]; calls above the last bound are only counted in Count.
+	Bounds  []time.Duration
+	Buckets []uint64
+	Count   uint64
+	Sum     time.Duration
+
+	// Connections per event (reused, new, failed)
+	Connections map[ConnectionEvent]uint64
+}
+
+// MemoryRecorder is a Recorder that aggregates metrics in memory.
+type MemoryRecorder struct {
+	mtx    sync.Mutex
+	bounds []time.Duration
+	stats  map[Tags]*CallStats
+}
+
+// NewMemoryRecorder returns a MemoryRecorder with the given histogram bucket
+// bounds, or DefaultBuckets if none are given.
+func NewMemoryRecorder(bounds ...time.Duration) *MemoryRecorder {
+	if len(bounds) == 0 {
+		bounds = DefaultBuckets
+	}
+
+	sorted := append([]time.Duration(nil), bounds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return &MemoryRecorder{bounds: sorted, stats: make(map[Tags]*CallStats)}
+}
+
+func (m *MemoryRecorder) ApiCall(tags Tags, elapsed time.Duration, result string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	s := m.get(tags)
+	s.Results[result]++
+	s.Count++
+	s.Sum += elapsed
+
+	for i, bound := range s.Bounds {
+		if elapsed <= bound {
+			s.Buckets[i]++
+			break
+		}
+	}
+}
+
+func (m *MemoryRecorder) Connection(tags Tags, event ConnectionEvent) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.get(tags).Connections[event]++
+}
+
+// Snapshot returns a copy of the current metrics, sorted by pool and target.
+// Buckets in the copy are cumulative.
+func (m *MemoryRecorder) Snapshot() []CallStats {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	snapshot := make([]CallStats, 0, len(m.stats))
+	for _, s := range m.stats {
+		c := CallStats{
+			Tags:        s.Tags,
+			Results:     make(map[string]uint64, len(s.Results)),
+			Bounds:      s.Bounds,
+			Buckets:     make([]uint64, len(s.Buckets)),
+			Count:       s.Count,
+			Sum:         s.Sum,
+			Connections: make(map[ConnectionEvent]uint64, len(s.Connections)),
+		}
+		for k, v := range s.Results {
+			c.Results[k] = v
+		}
+		var cumulative uint64
+		for i, v := range s.Buckets {
+			cumulative += v
+			c.Buckets[i] = cumulative
+		}
+		for k, v := range s.Connections {
+			c.Connections[k] = v
+		}
+		snapshot = append(snapshot, c)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].Tags.Pool != snapshot[j].Tags.Pool {
+			return snapshot[i].Tags.Pool < snapshot[j].Tags.Pool
+		}
+		return snapshot[i].Tags.Target < snapshot[j].Tags.Target
+	})
+
+	return snapshot
+}
+
+// Reset discards all the recorded metrics.
+func (m *MemoryRecorder) Reset() {
+	m.mtx.Lock()
+	m.stats = make(map[Tags]*CallStats)
+	m.mtx.Unlock()
+}
+
+func (m *MemoryRecorder) get(tags Tags) *CallStats {
+	s, ok := m.stats[tags]
+	if !ok {
+		s = &CallStats{
+			Tags:        tags,
+			Results:     make(map[string]uint64),
+			Bounds:      m.bounds,
+			Buckets:     make([]uint64, len(m.bounds)),
+			Connections: make(map[ConnectionEvent]uint64),
+		}
+		m.stats[tags] = s
+	}
+	return s
+}
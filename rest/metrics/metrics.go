@@ -0,0 +1,44 @@
+package metrics
+
+import "time"
+
+// Result values reported for api calls without a status code.
+const (
+	ResultError = "error"
+)
+
+// ConnectionEvent is the way a request obtained its connection.
+type ConnectionEvent string
+
+const (
+	ConnectionReused ConnectionEvent = "reused"
+	ConnectionNew    ConnectionEvent = "new"
+	ConnectionFailed ConnectionEvent = "failed"
+)
+
+// Tags identify the pool and the downstream target of a metric.
+type Tags struct {
+	Pool   string
+	Target string
+}
+
+// Recorder receives the metrics of the requests issued by a RequestBuilder.
+// Implementations must be safe for concurrent use.
+type Recorder interface {
+	// ApiCall records a call to the target, how long it took and its result,
+	// which is the status class ("2xx", "5xx", ...) or ResultError.
+	ApiCall(tags Tags, elapsed time.Duration, result string)
+
+	// Connection records how a request got its connection.
+	Connection(tags Tags, event ConnectionEvent)
+}
+
+// StatusClass returns the result of a call for the given status code.
+func StatusClass(statusCode int) string {
+	switch {
+	case statusCode >= 100 && statusCode < 600:
+		return string(rune('0'+statusCode/100)) + "xx"
+	default:
+		return ResultError
+	}
+}
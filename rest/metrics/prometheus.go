@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	apiCallTotal      = "rest_client_api_call_total"
+	apiCallDuration   = "rest_client_api_call_duration_seconds"
+	connectionsTotal  = "rest_client_connections_total"
+	prometheusContent = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// WritePrometheus writes the recorded metrics in the Prometheus text
+// exposition format.
+func (m *MemoryRecorder) WritePrometheus(w io.Writer) error {
+	snapshot := m.Snapshot()
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP %s Calls made to each target, by result.\n", apiCallTotal)
+	fmt.Fprintf(bw, "# TYPE %s counter\n", apiCallTotal)
+	for _, s := range snapshot {
+		for _, result := range sortedKeys(s.Results) {
+			fmt.Fprintf(bw, "%s{%s,result=%q} %d\n", apiCallTotal, labels(s.Tags), result, s.Results[result])
+		}
+	}
+
+	fmt.Fprintf(bw, "# HELP %s Latency of the calls made to each target.\n", apiCallDuration)
+	fmt.Fprintf(bw, "# TYPE %s histogram\n", apiCallDuration)
+	for _, s := range snapshot {
+		for i, bound := range s.Bounds {
+			le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+			fmt.Fprintf(bw, "%s_bucket{%s,le=%q} %d\n", apiCallDuration, labels(s.Tags), le, s.Buckets[i])
+		}
+		fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", apiCallDuration, labels(s.Tags), s.Count)
+		fmt.Fprintf(bw, "%s_sum{%s} %g\n", apiCallDuration, labels(s.Tags), s.Sum.Seconds())
+		fmt.Fprintf(bw, "%s_count{%s} %d\n", apiCallDuration, labels(s.Tags), s.Count)
+	}
+
+	fmt.Fprintf(bw, "# HELP %s Connections obtained for each target, by event.\n", connectionsTotal)
+	fmt.Fprintf(bw, "# TYPE %s counter\n", connectionsTotal)
+	for _, s := range snapshot {
+		events := make([]string, 0, len(s.Connections))
+		for event := range s.Connections {
+			events = append(events, string(event))
+		}
+		sort.Strings(events)
+		for _, event := range events {
+			fmt.Fprintf(bw, "%s{%s,event=%q} %d\n", connectionsTotal, labels(s.Tags), event, s.Connections[ConnectionEvent(event)])
+		}
+	}
+
+	return bw.Flush()
+}
+
+// PrometheusHandler returns an http.Handler that serves the metrics of the
+// recorder to a Prometheus scraper.
+func PrometheusHandler(m *MemoryRecorder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", prometheusContent)
+		m.WritePrometheus(w)
+	})
+}
+
+func labels(tags Tags) string {
+	return fmt.Sprintf(`pool="%s",target="%s"`, labelEscaper.Replace(tags.Pool), labelEscaper.Replace(tags.Target))
+}
+
+// labelEscaper escapes label values as the text exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
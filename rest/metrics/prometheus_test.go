@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func(m *MemoryRecorder)
+		want   string
+	}{
+		{
+			name:   "no metrics",
+			record: func(m *MemoryRecorder) {},
+			want: `# HELP rest_client_api_call_total Calls made to each target, by result.
+# TYPE rest_client_api_call_total counter
+# HELP rest_client_api_call_duration_seconds Latency of the calls made to each target.
+# TYPE rest_client_api_call_duration_seconds histogram
+# HELP rest_client_connections_total Connections obtained for each target, by event.
+# TYPE rest_client_connections_total counter
+`,
+		},
+		{
+			name: "calls and connections",
+			record: func(m *MemoryRecorder) {
+				tags := Tags{Pool: "pool", Target: "api.example"}
+				m.ApiCall(tags, 5*time.Millisecond, "2xx")
+				m.ApiCall(tags, 50*time.Millisecond, "5xx")
+				m.ApiCall(tags, time.Second, ResultError)
+				m.Connection(tags, ConnectionNew)
+				m.Connection(tags, ConnectionReused)
+				m.Connection(tags, ConnectionReused)
+			},
+			want: `# HELP rest_client_api_call_total Calls made to each target, by result.
+# TYPE rest_client_api_call_total counter
+rest_client_api_call_total{pool="pool",target="api.example",result="2xx"} 1
+rest_client_api_call_total{pool="pool",target="api.example",result="5xx"} 1
+rest_client_api_call_total{pool="pool",target="api.example",result="error"} 1
+# HELP rest_client_api_call_duration_seconds Latency of the calls made to each target.
+# TYPE rest_client_api_call_duration_seconds histogram
+rest_client_api_call_duration_seconds_bucket{pool="pool",target="api.example",le="0.01"} 1
+rest_client_api_call_duration_seconds_bucket{pool="pool",target="api.example",le="0.1"} 2
+rest_client_api_call_duration_seconds_bucket{pool="pool",target="api.example",le="+Inf"} 3
+rest_client_api_call_duration_seconds_sum{pool="pool",target="api.example"} 1.055
+rest_client_api_call_duration_seconds_count{pool="pool",target="api.example"} 3
+# HELP rest_client_connections_total Connections obtained for each target, by event.
+# TYPE rest_client_connections_total counter
+rest_client_connections_total{pool="pool",target="api.example",event="new"} 1
+rest_client_connections_total{pool="pool",target="api.example",event="reused"} 2
+`,
+		},
+		{
+			name: "escaped labels, sorted by pool",
+			record: func(m *MemoryRecorder) {
+				m.ApiCall(Tags{Pool: "b", Target: `quote"back\slash`}, time.Millisecond, "2xx")
+				m.ApiCall(Tags{Pool: "a", Target: "new\nline"}, time.Millisecond, "2xx")
+			},
+			want: `# HELP rest_client_api_call_total Calls made to each target, by result.
+# TYPE rest_client_api_call_total counter
+rest_client_api_call_total{pool="a",target="new\nline",result="2xx"} 1
+rest_client_api_call_total{pool="b",target="quote\"back\\slash",result="2xx"} 1
+# HELP rest_client_api_call_duration_seconds Latency of the calls made to each target.
+# TYPE rest_client_api_call_duration_seconds histogram
+rest_client_api_call_duration_seconds_bucket{pool="a",target="new\nline",le="0.01"} 1
+rest_client_api_call_duration_seconds_bucket{pool="a",target="new\nline",le="0.1"} 1
+rest_client_api_call_duration_seconds_bucket{pool="a",target="new\nline",le="+Inf"} 1
+rest_client_api_call_duration_seconds_sum{pool="a",target="new\nline"} 0.001
+rest_client_api_call_duration_seconds_count{pool="a",target="new\nline"} 1
+rest_client_api_call_duration_seconds_bucket{pool="b",target="quote\"back\\slash",le="0.01"} 1
+rest_client_api_call_duration_seconds_bucket{pool="b",target="quote\"back\\slash",le="0.1"} 1
+rest_client_api_call_duration_seconds_bucket{pool="b",target="quote\"back\\slash",le="+Inf"} 1
+rest_client_api_call_duration_seconds_sum{pool="b",target="quote\"back\\slash"} 0.001
+rest_client_api_call_duration_seconds_count{pool="b",target="quote\"back\\slash"} 1
+# HELP rest_client_connections_total Connections obtained for each target, by event.
+# TYPE rest_client_connections_total counter
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemoryRecorder(100*time.Millisecond, 10*time.Millisecond)
+			tt.record(m)
+
+			var out strings.Builder
+			if err := m.WritePrometheus(&out); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.String() != tt.want {
+				t.Fatalf("got:\n%s\nexpected:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	m := NewMemoryRecorder()
+	m.ApiCall(Tags{Pool: "pool", Target: "api.example"}, time.Millisecond, "2xx")
+
+	rec := httptest.NewRecorder()
+	PrometheusHandler(m).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if contentType := rec.Header().Get("Content-Type"); contentType != prometheusContent {
+		t.Fatalf("got Content-Type %q, expected %q", contentType, prometheusContent)
+	}
+	if !strings.Contains(rec.Body.String(), `rest_client_api_call_total{pool="pool",target="api.example",result="2xx"} 1`) {
+		t.Fatalf("unexpected body:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,169 @@
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Multipart is a multipart/form-data request body, made of fields, files and
+// custom parts. It can be sent as body with any ContentType.
+//
+// The body is streamed while the request is sent, reading each part at that
+// moment. Since readers can only be consumed once, requests with a Multipart
+// body are never retried.
+type Multipart struct {
+	boundary  string
+	parts     []multipartPart
+	closeOnce sync.Once
+}
+
+type multipartPart struct {
+	header textproto.MIMEHeader
+	reader io.Reader
+}
+
+// NewMultipart returns an empty Multipart body.
+func NewMultipart() *Multipart {
+	return &Multipart{boundary: multipart.NewWriter(ioutil.Discard).Boundary()}
+}
+
+// AddField adds a form field.
+func (m *Multipart) AddField(name string, value string) *Multipart {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, escapeQuotes(name)))
+	return m.AddPart(header, strings.NewReader(value))
+}
+
+// AddFile adds a file read from r. If r is an io.Closer, it is closed once
+// the request finishes, whether it was sent or not.
+func (m *Multipart) AddFile(fieldName string, fileName string, r io.Reader) *Multipart {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(fieldName), escapeQuotes(fileName)))
+	header.Set("Content-Type", "application/octet-stream")
+	return m.AddPart(header, r)
+}
+
+// AddPart adds a part with the given headers, read from r. If r is an
+// io.Closer, it is closed once the request finishes, whether it was sent or
+// not.
+func (m *Multipart) AddPart(header textproto.MIMEHeader, r io.Reader) *Multipart {
+	m.parts = append(m.parts, multipartPart{header, r})
+	return m
+}
+
+// Boundary returns the boundary that separates the parts.
+func (m *Multipart) Boundary() string {
+	return m.boundary
+}
+
+// FormDataContentType returns the Content-Type header of the body.
+func (m *Multipart) FormDataContentType() string {
+	return "multipart/form-data; boundary=" + m.boundary
+}
+
+// reader returns the body, written by a goroutine started on its first read.
+func (m *Multipart) reader() io.Reader {
+	return &multipartBody{multipart: m}
+}
+
+// multipartBody pipes the parts written by a goroutine. The goroutine starts
+// on the first read, so that requests that are never sent don't leave it
+// blocked.
+type multipartBody struct {
+	multipart *Multipart
+	once      sync.Once
+	pr        *io.PipeReader
+}
+
+func (b *multipartBody) start(send bool) {
+	b.once.Do(func() {
+		pr, pw := io.Pipe()
+		b.pr = pr
+
+		if !send {
+			pr.Close()
+			b.multipart.close()
+			return
+		}
+		go func() {
+			pw.CloseWithError(b.multipart.writeTo(pw))
+		}()
+	})
+}
+
+func (b *multipartBody) Read(p []byte) (int, error) {
+	b.start(true)
+	return b.pr.Read(p)
+}
+
+// Close stops the goroutine. If the body was never read, it closes the parts
+// without sending them.
+func (b *multipartBody) Close() error {
+	b.start(false)
+	return b.pr.Close()
+}
+
+func (m *Multipart) writeTo(w io.Writer) error {
+	defer m.close()
+
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(m.boundary); err != nil {
+		return err
+	}
+
+	for _, part := range m.parts {
+		pw, err := mw.CreatePart(part.header)
+		if err == nil {
+			_, err = io.Copy(pw, part.reader)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// close closes the readers of the parts that are an io.Closer.
+func (m *Multipart) close() {
+	m.closeOnce.Do(func() {
+		for _, part := range m.parts {
+			if closer, ok := part.reader.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	})
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// multipartBoundary returns the boundary of a pre-built multipart body, read
+// from its first delimiter line.
+func multipartBoundary(body []byte) (string, bool) {
+	line := body
+	if i := bytes.IndexByte(body, '\n'); i >= 0 {
+		line = body[:i]
+	}
+
+	line = bytes.TrimRight(line, "\r")
+	if !bytes.HasPrefix(line, []byte("--")) || len(line) <= 2 {
+		return "", false
+	}
+
+	boundary := string(line[2:])
+	if _, err := multipart.NewReader(bytes.NewReader(body), boundary).NextPart(); err != nil {
+		return "", false
+	}
+
+	return boundary, true
+}
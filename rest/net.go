@@ -2,14 +2,12 @@ package rest
 
 import (
 	"bytes"
-	"compress/gzip"
-	"encoding/json"
-	"encoding/xml"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"net"
 	"net/http"
 	"net/url"
@@ -20,6 +18,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/matiasnu/go-jopit-toolkit/rest/retry"
 	"github.com/matiasnu/go-jopit-toolkit/tracing"
 )
 
@@ -38,27 +37,41 @@ var defaultCheckRedirectFunc func(req *http.Request, via []*http.Request) error
 var poolMap sync.Map
 
 func (rb *RequestBuilder) DoRequest(verb string, reqURL string, reqBody interface{}, opts ...Option) *Response {
-	var after func(bool)
-
 	var reqOpt reqOptions
 
 	for _, opt := range opts {
 		opt(&reqOpt)
 	}
 
-	result := rb.doRequest(verb, reqURL, reqBody, reqOpt)
+	rb.initPoolName()
 
-	if after != nil {
-		success := result.Err == nil && result.StatusCode/100 != 5
-		after(success)
+	// The parts of a Multipart are closed even if it is never sent
+	if m, ok := reqBody.(*Multipart); ok {
+		defer m.close()
 	}
 
-	return result
+	return rb.doRequest(verb, reqURL, reqBody, reqOpt)
 }
 
 func (rb *RequestBuilder) doRequest(verb string, requestURL string, reqBody interface{}, opt reqOptions) (result *Response) {
 	result = new(Response)
-	requestURL = rb.BaseURL + requestURL
+	relativeURL := requestURL
+	path, err := opt.expandURL(requestURL)
+	if err != nil {
+		result.Err = err
+		return
+	}
+
+	// With a load balancer the base URL is picked on each attempt
+	lb := rb.LoadBalancer
+	if opt.absolute {
+		lb = nil
+	}
+
+	requestURL = path
+	if !opt.absolute && lb == nil {
+		requestURL = rb.BaseURL + path
+	}
 
 	// Marshal request to JSON or XML
 	body, err := rb.marshalReqBody(reqBody)
@@ -67,6 +80,13 @@ func (rb *RequestBuilder) doRequest(verb string, requestURL string, reqBody inte
 		return
 	}
 
+	if rb.CompressRequest {
+		if body, err = rb.compressBody(body); err != nil {
+			result.Err = err
+			return
+		}
+	}
+
 	// Parse URL and to point to Mockup server if applicable
 	resourceURL, err := parseURL(requestURL)
 	if err != nil {
@@ -74,118 +94,246 @@ func (rb *RequestBuilder) doRequest(verb string, requestURL string, reqBody inte
 		return
 	}
 
-	// Response objects
-	var httpResp *http.Response
-	var responseErr error
+	// Response cache, only for cacheable verbs
+	var cache ResourceCache
+	var key string
+	cacheURL := resourceURL
+	if lb != nil {
+		cacheURL = path
+	}
+	if _, ok := cacheableVerbs[verb]; ok && rb.EnableCache && !opt.stream {
+		cache = rb.getCache()
+	}
+
+	var entry *CacheEntry
+	conditional := false
 
-	end := false
+	ctx := opt.Context()
+	handler := rb.chain(opt)
+	strategy := opt.RetryStrategy(rb)
+	if rs, ok := strategy.(retry.RequestStrategy); ok {
+		strategy = rs.ForRequest()
+	}
+
+	// The same key on every attempt lets the server detect the repeated ones
+	idempotencyKey, err := rb.idempotencyKey(verb, opt)
+	if err != nil {
+		result.Err = err
+		return
+	}
+
+	var request *http.Request
+	var tried []*endpoint
 	retries := 0
-	for !end {
-		request, err := http.NewRequest(verb, resourceURL, bytes.NewBuffer(body))
+	for {
+		var ep *endpoint
+		if lb != nil {
+			if ep, err = lb.pick(tried); err != nil {
+				result.Err = err
+				return
+			}
+			requestURL = ep.url + path
+			if resourceURL, err = parseURL(requestURL); err != nil {
+				result.Err = err
+				return
+			}
+		}
+
+		request, err = rb.newRequest(verb, resourceURL, requestURL, body, opt)
 		if err != nil {
 			result.Err = err
 			return
 		}
 
-		// Set extra parameters
-		rb.setParams(request, requestURL)
-
-		request.Header.Set(socketTimeoutConfig, millisString(rb.getRequestTimeout()))
-		request.Header.Set(restClientPoolName, rb.poolName)
-
-		// Copy headers from options struct into new request object.
-		headers := opt.Headers()
-		for k := range headers {
-			request.Header.Add(k, headers.Get(k))
+		var balanced *balancedRequest
+		if ep != nil {
+			balanced = &balancedRequest{lb: lb, path: path, ep: ep}
+			request = withBalancedRequest(request, balanced)
 		}
 
-		// Copy tracing headers from request context.
-		traceHeaders := tracing.ForwardedHeaders(request.Context())
-		for header := range traceHeaders {
-			value := traceHeaders.Get(header)
+		if idempotencyKey != "" {
+			request.Header.Set(IDEMPOTENCY_HEADER, idempotencyKey)
+		}
 
-			request.Header.Set(header, value)
+		if retries > 0 {
+			request.Header.Set(RETRY_HEADER, strconv.Itoa(retries))
 		}
 
-		httpResp, responseErr = rb.getClient().Do(request)
-
-		if rb.RetryStrategy != nil {
-			retryResp := rb.RetryStrategy.ShouldRetry(request, httpResp, responseErr, retries)
-			if retryResp.Retry() {
-				retryFunc := func() (interface{}, error) {
-					// We might be retrying because of an error in the request. As stated
-					// in https://godoc.org/net/http#Client.Do If the returned error
-					// is nil, the Response will contain a non-nil Body which the
-					// user is expected to close.
-					if responseErr == nil {
-						drainBody(httpResp.Body)
-					}
-
-					time.Sleep(retryResp.Delay())
-					retries++
-					request.Header.Set(RETRY_HEADER, strconv.Itoa(retries))
-					return nil, nil
+		if retries == 0 && cache != nil {
+			key = cacheKey(verb, cacheURL, request.Header)
+			entry = cacheLookup(cache, key, request)
+			if entry != nil && !opt.revalidate && !cacheDirectives(request.Header).has("no-cache") {
+				now := time.Now()
+				if entry.Fresh(now) {
+					return entry.response(request)
 				}
-
-				if _, err := retryLimiter.Action(1, retryFunc); err == nil {
-					continue
+				if entry.staleWhileRevalidate(now) {
+					rb.revalidate(key, verb, relativeURL, opt)
+					return entry.response(request)
 				}
+			}
+		}
+
+		// Revalidate stale entries instead of fetching the whole body
+		if entry != nil {
+			conditional = entry.setValidators(request)
+		}
 
+		if ep != nil {
+			lb.start(ep)
+			result = handler(request)
+			if request.Context().Err() != nil || isCircuitOpen(result.Err) || balanced.hedged {
+				// The attempt never got an answer of the endpoint, or hedging
+				// already recorded it
+				lb.release(ep)
+			} else {
+				lb.done(ep, isSuccess(result))
 			}
+			tried = append(tried, ep)
+		} else {
+			result = handler(request)
 		}
-		end = true
+
+		// Never retry once the caller gave up on the request, or the breaker
+		// rejected it
+		if strategy == nil || ctx.Err() != nil || !body.replayable() || isCircuitOpen(result.Err) {
+			break
+		}
+
+		budget := rb.getRetryBudget()
+		budget.record(request.URL.Host, !isFailure(result.Response, result.Err))
+
+		retryResp := strategy.ShouldRetry(request, result.Response, result.Err, retries)
+		if !retryResp.Retry() || !fitsDeadline(ctx, retryResp.Delay()) || !budget.allow(request.URL.Host) {
+			break
+		}
+
+		result.discard()
+		if err := sleep(ctx, retryResp.Delay()); err != nil {
+			result = &Response{Err: err}
+			break
+		}
+		retries++
 	}
 
-	if responseErr != nil {
-		result.Err = responseErr
-		return
+	// Serve the stale entry if the server fails and the entry allows it
+	if entry != nil && (result.Err != nil || result.StatusCode >= http.StatusInternalServerError) && entry.staleIfError(time.Now()) {
+		result.discard()
+		return entry.response(request)
+	}
+
+	if cache != nil && result.Err == nil {
+		if conditional {
+			return cacheRevalidated(cache, key, entry, result)
+		}
+		cacheStore(cache, key, result)
+	}
+	return
+}
+
+// send issues a single attempt of a request and reads its response.
+func (rb *RequestBuilder) send(request *http.Request, opt reqOptions) *Response {
+	result := new(Response)
+
+	tags := rb.metricsTags(request)
+	request = rb.traceConnections(request, tags)
+
+	start := time.Now()
+	httpResp, err := rb.clientFor(opt).Do(request)
+	rb.recordApiCall(tags, time.Since(start), httpResp, err)
+
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	// Hand the body to the caller without reading it
+	if opt.stream {
+		result.Response = httpResp
+		result.stream, err = rb.streamBody(httpResp)
+		if err != nil {
+			httpResp.Body.Close()
+			result.Err = err
+		}
+		return result
 	}
 
 	// Read response
 	defer httpResp.Body.Close()
-	respBody, err := ioutil.ReadAll(httpResp.Body)
+	respBody, err := ioutil.ReadAll(limitBody(httpResp.Body, rb.MaxBodySize))
 
 	if err != nil {
 		result.Err = err
-		return
+		return result
 	}
 
 	result.Response = httpResp
-	if !rb.UncompressResponse {
-		result.byteBody = respBody
-	} else {
-		respEncoding := httpResp.Header.Get("Content-Encoding")
-		if respEncoding == "" {
-			respEncoding = httpResp.Header.Get("Content-Type")
-		}
-		switch respEncoding {
-		case "gzip":
-			fallthrough
-		case "application/x-gzip":
-			{
-				if len(respBody) == 0 {
-					break
-				}
-				gr, err := gzip.NewReader(bytes.NewBuffer(respBody))
-				defer gr.Close()
-				if err != nil {
-					result.Err = err
-				} else {
-					uncompressedData, err := ioutil.ReadAll(gr)
-					if err != nil {
-						result.Err = err
-					} else {
-						result.byteBody = uncompressedData
-					}
-				}
-			}
-		default:
-			{
-				result.byteBody = respBody
-			}
-		}
+	result.byteBody = respBody
+
+	encoding := responseEncoding(httpResp)
+	if !rb.UncompressResponse || encoding == "" || !supportedEncoding(encoding) || len(respBody) == 0 {
+		return result
 	}
-	return
+
+	reader, err := uncompress(bytes.NewReader(respBody), encoding)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.byteBody, err = ioutil.ReadAll(limitBody(reader, rb.MaxBodySize))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	uncompressed(httpResp)
+
+	return result
+}
+
+func (rb *RequestBuilder) newRequest(verb string, resourceURL string, requestURL string, body reqBody, opt reqOptions) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(opt.Context(), verb, resourceURL, body.reader())
+	if err != nil {
+		return nil, err
+	}
+
+	// Set extra parameters
+	rb.setParams(request, requestURL)
+
+	if body.contentType != "" {
+		request.Header.Set("Content-Type", body.contentType)
+	}
+	if body.encoding != "" {
+		request.Header.Set("Content-Encoding", body.encoding)
+	}
+
+	request.Header.Set(socketTimeoutConfig, millisString(rb.getRemainingTimeout(request.Context(), opt)))
+
+	if opt.authorization != "" {
+		request.Header.Set("Authorization", opt.authorization)
+	}
+	request.Header.Set(restClientPoolName, rb.poolName)
+
+	// Copy headers from options struct into new request object.
+	headers := opt.Headers()
+	for k := range headers {
+		request.Header.Add(k, headers.Get(k))
+	}
+
+	// Accept the codec type, unless the caller asked for another
+	if rc, ok := codecFor(rb.ContentType); ok && rc.accept && request.Header.Get("Accept") == "" {
+		request.Header.Set("Accept", rc.mimeTypes[0])
+	}
+
+	// Copy tracing headers from request context.
+	traceHeaders := tracing.ForwardedHeaders(request.Context())
+	for header := range traceHeaders {
+		value := traceHeaders.Get(header)
+
+		request.Header.Set(header, value)
+	}
+
+	return request, nil
 }
 
 // parseURL parses the URL to verify it is a valid one and returns
@@ -206,48 +354,65 @@ func parseURL(reqURL string) (string, error) {
 	return reqURL, nil
 }
 
-func (rb *RequestBuilder) marshalReqBody(body interface{}) (b []byte, err error) {
+// reqBody is a marshaled request body, ready to be sent on each attempt.
+type reqBody struct {
+	data        []byte
+	multipart   *Multipart
+	contentType string
+	encoding    string
+}
+
+func (b reqBody) reader() io.Reader {
+	if b.multipart != nil {
+		return b.multipart.reader()
+	}
+	return bytes.NewBuffer(b.data)
+}
+
+// replayable returns false if the body can only be sent once.
+func (b reqBody) replayable() bool {
+	return b.multipart == nil
+}
+
+func (rb *RequestBuilder) marshalReqBody(body interface{}) (b reqBody, err error) {
+	if m, ok := body.(*Multipart); ok {
+		return reqBody{multipart: m, contentType: m.FormDataContentType()}, nil
+	}
+
 	if body != nil {
 		switch rb.ContentType {
-		case JSON:
-			b, err = json.Marshal(body)
-		case XML:
-			b, err = xml.Marshal(body)
 		case BYTES:
 			var ok bool
-			b, ok = body.([]byte)
+			b.data, ok = body.([]byte)
 			if !ok {
 				err = fmt.Errorf("bytes: body is %T(%v) not a byte slice", body, body)
 			}
 		case MULTIPART:
 			b, err = marshalMultipart(body)
+		default:
+			rc, ok := codecFor(rb.ContentType)
+			if !ok {
+				return b, fmt.Errorf("no codec registered for content type %d", rb.ContentType)
+			}
+			b.data, err = rc.codec.Marshal(body)
 		}
 	}
 
 	return
 }
 
-func marshalMultipart(body interface{}) ([]byte, error) {
+func marshalMultipart(body interface{}) (reqBody, error) {
 	buffer, ok := body.(*bytes.Buffer)
 	if !ok {
-		return nil, fmt.Errorf("bytes: body is %T(%v) not a byte buffer", body, body)
-	}
-
-	if !isMultipartBuffer(buffer) {
-		return nil, fmt.Errorf("bytes: body is %T(%v) not a multipart", body, body)
+		return reqBody{}, fmt.Errorf("bytes: body is %T(%v) not a byte buffer", body, body)
 	}
 
-	return buffer.Bytes(), nil
-}
-
-func isMultipartBuffer(buffer *bytes.Buffer) bool {
-	writer := multipart.NewWriter(buffer)
-	_, err := writer.CreateFormFile("file", "multipartTest")
-	if err != nil {
-		return false
+	boundary, ok := multipartBoundary(buffer.Bytes())
+	if !ok {
+		return reqBody{}, fmt.Errorf("bytes: body is %T(%v) not a multipart", body, body)
 	}
 
-	return true
+	return reqBody{data: buffer.Bytes(), contentType: "multipart/form-data; boundary=" + boundary}, nil
 }
 
 func (rb *RequestBuilder) getClient() *http.Client {
@@ -260,6 +425,7 @@ func (rb *RequestBuilder) getClient() *http.Client {
 		}
 
 		if rb.Client.Transport == nil {
+			rb.Client.Transport = rb.getTransport()
 			rb.Client.Timeout = rb.getRequestTimeout()
 		}
 
@@ -275,6 +441,19 @@ func (rb *RequestBuilder) getClient() *http.Client {
 	return rb.Client
 }
 
+// clientFor returns the client for a call, which is a copy of the
+// RequestBuilder one if the call overrides the timeout.
+func (rb *RequestBuilder) clientFor(opt reqOptions) *http.Client {
+	client := rb.getClient()
+	if opt.timeout <= 0 {
+		return client
+	}
+
+	custom := *client
+	custom.Timeout = opt.timeout
+	return &custom
+}
+
 func (rb *RequestBuilder) getTransport() http.RoundTripper {
 	cp := rb.CustomPool
 	if cp == nil {
@@ -285,19 +464,81 @@ func (rb *RequestBuilder) getTransport() http.RoundTripper {
 		if cp.Transport == nil {
 			cp.Transport = rb.makeTransport()
 		} else if ctr, ok := cp.Transport.(*http.Transport); ok {
-			ctr.DialContext = (&net.Dialer{Timeout: rb.getConnectionTimeout()}).DialContext
+			ctr.DialContext = cp.stats.dialContext(rb.makeDialer().DialContext)
+			if err := cp.configure(ctr); err != nil {
+				cp.Transport = errorTransport{err}
+			}
 		}
+		cp.statsTransport = &statsTransport{next: cp.Transport, stats: &cp.stats}
 	})
 
-	return cp.Transport
+	return cp.statsTransport
 }
 
 func (rb *RequestBuilder) makeTransport() http.RoundTripper {
-	return &http.Transport{
+	transport := &http.Transport{
 		MaxIdleConnsPerHost: rb.getMaxIdleConnsPerHost(),
 		Proxy:               rb.getProxy(),
-		DialContext:         (&net.Dialer{Timeout: rb.getConnectionTimeout()}).DialContext,
+		DialContext:         rb.makeDialer().DialContext,
+		IdleConnTimeout:     DefaultIdleConnTimeout,
+		TLSHandshakeTimeout: DefaultTLSHandshakeTimeout,
+		ForceAttemptHTTP2:   true,
+	}
+
+	if cp := rb.CustomPool; cp != nil {
+		transport.DialContext = cp.stats.dialContext(transport.DialContext)
+		if err := cp.configure(transport); err != nil {
+			return errorTransport{err}
+		}
+	}
+	return transport
+}
+
+func (rb *RequestBuilder) makeDialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: rb.getConnectionTimeout()}
+	if cp := rb.CustomPool; cp != nil {
+		dialer.KeepAlive = cp.KeepAlive
+	}
+	return dialer
+}
+
+// configure applies the settings of the pool to its transport. Zero values
+// keep the transport ones.
+func (cp *CustomPool) configure(transport *http.Transport) error {
+	if cp.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cp.MaxIdleConns
+	}
+	if cp.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = cp.MaxConnsPerHost
+	}
+	if cp.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cp.IdleConnTimeout
+	}
+	if cp.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = cp.TLSHandshakeTimeout
+	}
+	if cp.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = cp.ResponseHeaderTimeout
+	}
+	if cp.DisableKeepAlives {
+		transport.DisableKeepAlives = true
 	}
+	if cp.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	if cp.TLS != nil {
+		files, err := newTLSFiles(*cp.TLS)
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = files.clientConfig()
+		if files.reloadable() && !cp.TLS.InsecureSkipVerify {
+			transport.DialTLSContext = files.dialTLS(transport)
+		}
+	}
+	return nil
 }
 
 func (rb *RequestBuilder) getRequestTimeout() time.Duration {
@@ -311,6 +552,24 @@ func (rb *RequestBuilder) getRequestTimeout() time.Duration {
 	}
 }
 
+// getRemainingTimeout returns the request timeout, bounded by the time left
+// until the context deadline.
+func (rb *RequestBuilder) getRemainingTimeout(ctx context.Context, opt reqOptions) time.Duration {
+	timeout := rb.getRequestTimeout()
+	if opt.timeout > 0 {
+		timeout = opt.timeout
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if timeout < 0 {
+		return 0
+	}
+	return timeout
+}
+
 func (rb *RequestBuilder) getConnectionTimeout() time.Duration {
 	switch {
 	case rb.DisableTimeout:
@@ -372,18 +631,13 @@ func (rb *RequestBuilder) setParams(req *http.Request, resourceURL string) {
 	}())
 
 	// Encoding
-	var cType string
-
-	switch rb.ContentType {
-	case JSON:
-		cType = "json"
-	case XML:
-		cType = "xml"
+	if rc, ok := codecFor(rb.ContentType); ok {
+		req.Header.Set("Content-Type", rc.mimeTypes[0])
 	}
 
-	if cType != "" {
-		req.Header.Set("Accept", "application/"+cType)
-		req.Header.Set("Content-Type", "application/"+cType)
+	// Negotiate the compression of the response
+	if rb.UncompressResponse {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
 	}
 }
 
@@ -399,6 +653,26 @@ func drainBody(body io.ReadCloser) {
 	io.Copy(ioutil.Discard, io.LimitReader(body, respReadLimit))
 }
 
+// sleep waits for d, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fitsDeadline returns false if after waiting d the context deadline would
+// already be reached.
+func fitsDeadline(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Now().Add(d).Before(deadline)
+}
+
 func millisString(d time.Duration) string {
 	return strconv.Itoa(int(d.Seconds() * 1000))
 }
@@ -0,0 +1,225 @@
+package rest
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource provides the bearer tokens sent on the requests of a
+// RequestBuilder. Implementations must be safe for concurrent use.
+type TokenSource interface {
+	// Token returns a valid token, obtaining a new one if needed.
+	Token(ctx context.Context) (string, error)
+
+	// Invalidate discards the token, if it is still the current one, so the
+	// next call to Token obtains a new one.
+	Invalidate(token string)
+}
+
+// ClientCredentialsConfig configures a TokenSource that obtains tokens with
+// the OAuth2 client credentials grant.
+type ClientCredentialsConfig struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// Extra parameters sent to the token endpoint
+	EndpointParams url.Values
+
+	// Send the client credentials as form parameters instead of using Basic Auth
+	AuthInParams bool
+
+	// How long before its expiry a token is renewed, 10s by default. It is
+	// at most half the lifetime of the token.
+	ExpiryDelta time.Duration
+
+	// Optional RequestBuilder used to call the token endpoint, its
+	// ContentType must be FORM
+	Client *RequestBuilder
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type clientCredentials struct {
+	config ClientCredentialsConfig
+	client *RequestBuilder
+
+	mtx    sync.Mutex
+	token  string
+	expiry time.Time
+	err    error
+
+	// Closed when the token request in flight finishes
+	fetching chan struct{}
+}
+
+// NewClientCredentialsSource returns a TokenSource that caches the token
+// until shortly before it expires. Concurrent callers share a single request
+// to the token endpoint.
+func NewClientCredentialsSource(config ClientCredentialsConfig) TokenSource {
+	if config.ExpiryDelta <= 0 {
+		config.ExpiryDelta = 10 * time.Second
+	}
+
+	client := config.Client
+	if client == nil {
+		client = &RequestBuilder{ContentType: FORM}
+	}
+
+	return &clientCredentials{config: config, client: client}
+}
+
+func (c *clientCredentials) Token(ctx context.Context) (string, error) {
+	c.mtx.Lock()
+	if c.valid(time.Now()) {
+		token := c.token
+		c.mtx.Unlock()
+		return token, nil
+	}
+
+	// The token request is shared, so it must not be canceled by this caller
+	if c.fetching == nil {
+		c.fetching = make(chan struct{})
+		go c.fetch(detachedContext{ctx})
+	}
+	fetching := c.fetching
+	c.mtx.Unlock()
+
+	select {
+	case <-fetching:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.token, nil
+}
+
+func (c *clientCredentials) Invalidate(token string) {
+	c.mtx.Lock()
+	if c.token == token {
+		c.token = ""
+	}
+	c.mtx.Unlock()
+}
+
+func (c *clientCredentials) valid(now time.Time) bool {
+	return c.token != "" && (c.expiry.IsZero() || now.Before(c.expiry))
+}
+
+func (c *clientCredentials) fetch(ctx context.Context) {
+	token, expiry, err := c.request(ctx)
+
+	c.mtx.Lock()
+	c.err = err
+	if err == nil {
+		c.token, c.expiry = token, expiry
+	}
+	close(c.fetching)
+	c.fetching = nil
+	c.mtx.Unlock()
+}
+
+func (c *clientCredentials) request(ctx context.Context) (string, time.Time, error) {
+	params := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.config.Scopes) > 0 {
+		params.Set("scope", strings.Join(c.config.Scopes, " "))
+	}
+	for k, values := range c.config.EndpointParams {
+		params[k] = values
+	}
+
+	headers := make(http.Header)
+	if c.config.AuthInParams {
+		params.Set("client_id", c.config.ClientID)
+		params.Set("client_secret", c.config.ClientSecret)
+	} else {
+		credentials := url.QueryEscape(c.config.ClientID) + ":" + url.QueryEscape(c.config.ClientSecret)
+		headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	headers.Set("Accept", "application/json")
+
+	now := time.Now()
+	response := c.client.Post(c.config.TokenURL, params, Context(ctx), Headers(headers))
+	if response.Err != nil {
+		return "", time.Time{}, fmt.Errorf("oauth2: cannot fetch token: %w", response.Err)
+	}
+	if response.StatusCode/100 != 2 {
+		return "", time.Time{}, fmt.Errorf("oauth2: cannot fetch token: %s, body: %s", response.Status, response.String())
+	}
+
+	var tr tokenResponse
+	if err := response.FillUp(&tr); err != nil {
+		return "", time.Time{}, fmt.Errorf("oauth2: cannot parse token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("oauth2: server response missing access_token")
+	}
+
+	var expiry time.Time
+	if tr.ExpiresIn > 0 {
+		// Short lived tokens must not be expired as soon as they are fetched
+		lifetime := time.Duration(tr.ExpiresIn) * time.Second
+		delta := c.config.ExpiryDelta
+		if delta > lifetime/2 {
+			delta = lifetime / 2
+		}
+		expiry = now.Add(lifetime - delta)
+	}
+
+	return tr.AccessToken, expiry, nil
+}
+
+// tokenInterceptor sets the bearer token of the source on each request. On a
+// 401 (Unauthorized) it retries once with a new token, if the request body
+// can be sent again.
+func tokenInterceptor(ts TokenSource) Interceptor {
+	return func(req *http.Request, next Handler) *Response {
+		token, err := ts.Token(req.Context())
+		if err != nil {
+			return &Response{Err: err}
+		}
+
+		retry := req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		result := next(req)
+		if result.Err != nil || result.StatusCode != http.StatusUnauthorized {
+			return result
+		}
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return result
+		}
+
+		ts.Invalidate(token)
+		if token, err = ts.Token(req.Context()); err != nil {
+			return result
+		}
+
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return result
+			}
+		}
+
+		result.discard()
+		retry.Header.Set("Authorization", "Bearer "+token)
+		return next(retry)
+	}
+}
@@ -2,12 +2,50 @@ package rest
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matiasnu/go-jopit-toolkit/rest/retry"
 )
 
 type reqOptions struct {
 	ctx     context.Context
 	headers http.Header
+
+	// Skip serving from cache, used for background revalidations
+	revalidate bool
+
+	// Don't read the response body, leave it to the caller
+	stream bool
+
+	// Per call overrides of the RequestBuilder settings
+	timeout       time.Duration
+	retryStrategy retry.RetryStrategy
+	retrySet      bool
+	query         url.Values
+	pathParams    map[string]string
+	authorization string
+
+	// The URL doesn't need the BaseURL, as it is already absolute
+	absolute bool
+
+	// Tokens taken from the RequestBuilder RateLimiter by each attempt
+	weight uint64
+
+	idempotencyKey string
+}
+
+// RetryStrategy returns the retry strategy of the call, which defaults to
+// the RequestBuilder one.
+func (opt *reqOptions) RetryStrategy(rb *RequestBuilder) retry.RetryStrategy {
+	if opt.retrySet {
+		return opt.retryStrategy
+	}
+	return rb.RetryStrategy
 }
 
 // Context returns the context.Context or a new background
@@ -41,3 +79,168 @@ func Headers(headers http.Header) Option {
 		opt.headers = headers
 	}
 }
+
+// Stream makes the request return as soon as the response headers arrive,
+// leaving the body to be read from Response.Reader(), which the caller must
+// close. Gzip encoded bodies are uncompressed while read.
+//
+// Streamed responses are never cached, and keep in mind the RequestBuilder
+// Timeout also bounds the time spent reading the body.
+func Stream() Option {
+	return func(opt *reqOptions) {
+		opt.stream = true
+	}
+}
+
+// Timeout overrides the RequestBuilder Timeout for this call.
+func Timeout(timeout time.Duration) Option {
+	return func(opt *reqOptions) {
+		opt.timeout = timeout
+	}
+}
+
+// Retry overrides the RequestBuilder RetryStrategy for this call.
+func Retry(strategy retry.RetryStrategy) Option {
+	return func(opt *reqOptions) {
+		opt.retryStrategy = strategy
+		opt.retrySet = true
+	}
+}
+
+// NoRetry disables the retries for this call.
+func NoRetry() Option {
+	return Retry(nil)
+}
+
+// Query adds the given values to the query string of the URL. It may be
+// given several times.
+func Query(values url.Values) Option {
+	return func(opt *reqOptions) {
+		if opt.query == nil {
+			opt.query = make(url.Values)
+		}
+		for k, v := range values {
+			opt.query[k] = append(opt.query[k], v...)
+		}
+	}
+}
+
+// PathParams replaces each {name} placeholder of the URL with the escaped
+// value of the name param.
+func PathParams(params map[string]string) Option {
+	return func(opt *reqOptions) {
+		opt.pathParams = params
+	}
+}
+
+// Credentials sets the Basic Auth of this call, overriding the
+// RequestBuilder BasicAuth and TokenSource.
+func Credentials(userName string, password string) Option {
+	return func(opt *reqOptions) {
+		credentials := base64.StdEncoding.EncodeToString([]byte(userName + ":" + password))
+		opt.authorization = "Basic " + credentials
+	}
+}
+
+// BearerToken sets the bearer token of this call, overriding the
+// RequestBuilder BasicAuth and TokenSource.
+func BearerToken(token string) Option {
+	return func(opt *reqOptions) {
+		opt.authorization = "Bearer " + token
+	}
+}
+
+// Weight sets the tokens each attempt of this call takes from the
+// RequestBuilder RateLimiter, 1 by default.
+func Weight(weight uint64) Option {
+	return func(opt *reqOptions) {
+		opt.weight = weight
+	}
+}
+
+// IdempotencyKey sets the IDEMPOTENCY_HEADER sent on every attempt of this
+// call, instead of a generated one.
+func IdempotencyKey(key string) Option {
+	return func(opt *reqOptions) {
+		opt.idempotencyKey = key
+	}
+}
+
+// absoluteURL skips the BaseURL of the RequestBuilder, for URLs returned by
+// the API itself. They already carry their whole query, so the query and
+// path param options given before are dropped.
+func absoluteURL() Option {
+	return func(opt *reqOptions) {
+		opt.absolute = true
+		opt.query = nil
+		opt.pathParams = nil
+	}
+}
+
+// expandURL applies the path params and query options to the URL.
+func (opt *reqOptions) expandURL(rawURL string) (string, error) {
+	if opt.pathParams != nil {
+		expanded, err := expandPath(rawURL, opt.pathParams)
+		if err != nil {
+			return rawURL, err
+		}
+		rawURL = expanded
+	}
+
+	if len(opt.query) == 0 {
+		return rawURL, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL, err
+	}
+
+	query := u.Query()
+	for k, values := range opt.query {
+		for _, v := range values {
+			query.Add(k, v)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+func expandPath(rawURL string, params map[string]string) (string, error) {
+	var expanded strings.Builder
+	for {
+		start := strings.IndexByte(rawURL, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rawURL[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		name := rawURL[start+1 : end]
+		value, ok := params[name]
+		if !ok {
+			return "", fmt.Errorf("missing path param %q", name)
+		}
+
+		expanded.WriteString(rawURL[:start])
+		expanded.WriteString(url.PathEscape(value))
+		rawURL = rawURL[end+1:]
+	}
+	expanded.WriteString(rawURL)
+
+	return expanded.String(), nil
+}
+
+// detachedContext keeps the values of its parent, like tracing headers, but
+// not its deadline or cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,363 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxPages is the maximum number of pages fetched by a Paginator when
+// the PaginateConfig MaxPages is 0.
+var DefaultMaxPages = 1000
+
+// ErrMaxPages is the error of a Paginator that stopped after fetching the
+// maximum number of pages, before reaching the last one.
+var ErrMaxPages = errors.New("pagination stopped after max pages")
+
+// PaginationStrategy is the way an API links its pages.
+type PaginationStrategy int
+
+const (
+	// OffsetPagination requests the pages with offset and limit query params,
+	// until a page has less than limit items
+	OffsetPagination PaginationStrategy = iota
+
+	// CursorPagination requests each page with the cursor found in the body
+	// of the previous one, until a page has no cursor
+	CursorPagination
+
+	// LinkPagination follows the rel="next" link of the Link header
+	// (RFC 5988), until a page has no such link
+	LinkPagination
+)
+
+// PaginateConfig configures a Paginator. Zero values take the defaults
+// described on each field.
+type PaginateConfig struct {
+	Strategy PaginationStrategy
+
+	// Query params of the OffsetPagination, "offset" and "limit" by default
+	OffsetParam string
+	LimitParam  string
+
+	// Items per page of the OffsetPagination, 50 by default
+	Limit int
+
+	// Dot separated path to the next cursor in the JSON body, like
+	// "paging.next". Required by the CursorPagination.
+	CursorPath string
+
+	// Query param the cursor is sent in, "cursor" by default
+	CursorParam string
+
+	// Dot separated path to the items array in the JSON body, like "results".
+	// Empty means the body is the array.
+	ItemsPath string
+
+	// Maximum number of pages fetched, DefaultMaxPages if 0
+	MaxPages int
+
+	// Options of every page request. The query and path param options only
+	// apply to the first page of the LinkPagination, whose next links carry
+	// the whole URL.
+	Options []Option
+
+	// Optional context, canceling it stops the pagination
+	Context context.Context
+}
+
+// Paginator walks the pages of a paginated API. Use it like a bufio.Scanner:
+//
+//	p := rb.Paginate("/items", rest.PaginateConfig{ItemsPath: "results"})
+//	for p.Next() {
+//		var items []Item
+//		if err := p.Items(&items); err != nil {
+//			...
+//		}
+//	}
+//	if err := p.Err(); err != nil {
+//		...
+//	}
+//
+// A Paginator is not safe for concurrent use.
+type Paginator struct {
+	rb     *RequestBuilder
+	config PaginateConfig
+
+	next     string
+	absolute bool
+	query    url.Values
+	pages    int
+	offset   int
+	done     bool
+	err      error
+	response *Response
+}
+
+// Paginate returns a Paginator over the pages of resource, which is
+// requested with GET.
+func (rb *RequestBuilder) Paginate(resource string, config PaginateConfig) *Paginator {
+	if config.OffsetParam == "" {
+		config.OffsetParam = "offset"
+	}
+	if config.LimitParam == "" {
+		config.LimitParam = "limit"
+	}
+	if config.Limit <= 0 {
+		config.Limit = 50
+	}
+	if config.CursorParam == "" {
+		config.CursorParam = "cursor"
+	}
+	if config.MaxPages <= 0 {
+		config.MaxPages = DefaultMaxPages
+	}
+	if config.Context == nil {
+		config.Context = context.Background()
+	}
+
+	p := &Paginator{rb: rb, config: config, next: resource}
+	if config.Strategy == OffsetPagination {
+		p.query = url.Values{
+			config.OffsetParam: {"0"},
+			config.LimitParam:  {strconv.Itoa(config.Limit)},
+		}
+	}
+	if config.Strategy == CursorPagination && config.CursorPath == "" {
+		p.stop(errors.New("pagination: CursorPagination needs a CursorPath"))
+	}
+	return p
+}
+
+// Next fetches the next page, which is then available through Response, Page
+// and Items. It returns false when there are no more pages or on error, which
+// is returned by Err.
+func (p *Paginator) Next() bool {
+	if p.done {
+		return false
+	}
+	if p.pages >= p.config.MaxPages {
+		p.stop(ErrMaxPages)
+		return false
+	}
+	if err := p.config.Context.Err(); err != nil {
+		p.stop(err)
+		return false
+	}
+
+	opts := append([]Option{}, p.config.Options...)
+	opts = append(opts, Context(p.config.Context))
+	if p.query != nil {
+		opts = append(opts, Query(p.query))
+	}
+	// Applied last, to drop the query and path params of the options
+	if p.absolute {
+		opts = append(opts, absoluteURL())
+	}
+
+	response := p.rb.Get(p.next, opts...)
+	if apiErr := response.ApiError(); apiErr != nil {
+		p.stop(apiErr)
+		return false
+	}
+
+	p.pages++
+	p.response = response
+
+	if err := p.advance(); err != nil {
+		p.stop(err)
+		return false
+	}
+	return true
+}
+
+// advance prepares the request of the page after the current one, or marks
+// the pagination as done after the current page.
+func (p *Paginator) advance() error {
+	switch p.config.Strategy {
+	case OffsetPagination:
+		items, err := p.rawItems()
+		if err != nil {
+			return err
+		}
+		if len(items) < p.config.Limit {
+			p.done = true
+			break
+		}
+		p.offset += len(items)
+		p.query.Set(p.config.OffsetParam, strconv.Itoa(p.offset))
+
+	case CursorPagination:
+		raw, err := jsonPath(p.response.Bytes(), p.config.CursorPath)
+		if err != nil {
+			return err
+		}
+		cursor, err := cursorString(raw)
+		if err != nil {
+			return err
+		}
+		if cursor == "" {
+			p.done = true
+			break
+		}
+		p.query = url.Values{p.config.CursorParam: {cursor}}
+
+	case LinkPagination:
+		next := nextLink(p.response.Header.Get("Link"))
+		if next == "" {
+			p.done = true
+			break
+		}
+		ref, err := url.Parse(next)
+		if err != nil {
+			return fmt.Errorf("pagination: invalid next link %q: %w", next, err)
+		}
+		p.next = p.response.Request.URL.ResolveReference(ref).String()
+		p.absolute = true
+
+	default:
+		return fmt.Errorf("pagination: unknown strategy %d", p.config.Strategy)
+	}
+	return nil
+}
+
+func (p *Paginator) stop(err error) {
+	p.done = true
+	p.err = err
+	p.response = nil
+}
+
+// Err returns the error that stopped the pagination, if any.
+func (p *Paginator) Err() error {
+	return p.err
+}
+
+// Pages returns the number of pages fetched so far.
+func (p *Paginator) Pages() int {
+	return p.pages
+}
+
+// Response returns the response of the current page.
+func (p *Paginator) Response() *Response {
+	return p.response
+}
+
+// Page decodes the current page into fill, like Response.FillUp.
+func (p *Paginator) Page(fill interface{}) error {
+	if p.response == nil {
+		return errors.New("pagination: no current page")
+	}
+	return p.response.FillUp(fill)
+}
+
+// Items decodes the items of the current page, found at the ItemsPath of its
+// JSON body, into fill, which should be a pointer to a slice.
+func (p *Paginator) Items(fill interface{}) error {
+	if p.response == nil {
+		return errors.New("pagination: no current page")
+	}
+
+	raw, err := jsonPath(p.response.Bytes(), p.config.ItemsPath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, fill)
+}
+
+func (p *Paginator) rawItems() ([]json.RawMessage, error) {
+	raw, err := jsonPath(p.response.Bytes(), p.config.ItemsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("pagination: items at %q are not an array: %w", p.config.ItemsPath, err)
+	}
+	return items, nil
+}
+
+// jsonPath returns the value found at the dot separated path of a JSON
+// document. Path elements may be object keys or array indexes. A missing
+// value is returned as null.
+func jsonPath(data []byte, path string) (json.RawMessage, error) {
+	raw := json.RawMessage(data)
+	if path == "" {
+		return raw, nil
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		if index, err := strconv.Atoi(key); err == nil {
+			var array []json.RawMessage
+			if err := json.Unmarshal(raw, &array); err == nil {
+				if index < 0 || index >= len(array) {
+					return json.RawMessage("null"), nil
+				}
+				raw = array[index]
+				continue
+			}
+		}
+
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil, fmt.Errorf("pagination: can't follow path %q at %q: %w", path, key, err)
+		}
+
+		value, ok := object[key]
+		if !ok {
+			return json.RawMessage("null"), nil
+		}
+		raw = value
+	}
+	return raw, nil
+}
+
+// cursorString returns a string or numeric cursor as a string, and null as an
+// empty one.
+func cursorString(raw json.RawMessage) (string, error) {
+	var cursor interface{}
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return "", err
+	}
+
+	switch c := cursor.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return c, nil
+	case float64:
+		return strconv.FormatFloat(c, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("pagination: cursor is %T(%v) not a string or number", cursor, cursor)
+}
+
+var linkRel = regexp.MustCompile(`(?i)rel\s*=\s*"?([^";]*)"?`)
+
+// nextLink returns the URL of the rel="next" link of a Link header.
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			match := linkRel.FindStringSubmatch(param)
+			if match == nil {
+				continue
+			}
+			for _, rel := range strings.Fields(match[1]) {
+				if strings.EqualFold(rel, "next") {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
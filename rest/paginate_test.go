@@ -0,0 +1,102 @@
+package rest
+
+import (
+	"testing"
+)
+
+func TestNextLink(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "empty", header: "", want: ""},
+		{name: "only next", header: `<https://api.example/items?page=2>; rel="next"`, want: "https://api.example/items?page=2"},
+		{
+			name:   "next among others",
+			header: `<https://api.example/items?page=1>; rel="prev", <https://api.example/items?page=3>; rel="next", <https://api.example/items?page=9>; rel="last"`,
+			want:   "https://api.example/items?page=3",
+		},
+		{name: "unquoted rel", header: `</items?page=2>; rel=next`, want: "/items?page=2"},
+		{name: "several rels", header: `</items?page=2>; rel="next last"`, want: "/items?page=2"},
+		{name: "case insensitive", header: `</items?page=2>; REL="Next"`, want: "/items?page=2"},
+		{name: "other params", header: `</items?page=2>; title="more"; rel="next"`, want: "/items?page=2"},
+		{name: "no next", header: `</items?page=1>; rel="prev"`, want: ""},
+		{name: "target without brackets", header: `/items?page=2; rel="next"`, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextLink(tt.header); got != tt.want {
+				t.Fatalf("got %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	const document = `{"data":{"items":[{"id":1},{"id":2}],"next":"abc"},"meta":null}`
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty path", path: "", want: document},
+		{name: "object key", path: "data.next", want: `"abc"`},
+		{name: "array index", path: "data.items.1.id", want: "2"},
+		{name: "index out of range", path: "data.items.5", want: "null"},
+		{name: "missing key", path: "data.cursor", want: "null"},
+		{name: "null value", path: "meta", want: "null"},
+		{name: "key of a scalar", path: "data.next.value", wantErr: true},
+		{name: "key of an array", path: "data.items.id", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jsonPath([]byte(document), tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got %s, expected %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCursorString(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{name: "string", raw: `"abc"`, want: "abc"},
+		{name: "integer", raw: `42`, want: "42"},
+		{name: "large integer", raw: `1700000000000`, want: "1700000000000"},
+		{name: "null", raw: `null`, want: ""},
+		{name: "empty string", raw: `""`, want: ""},
+		{name: "object", raw: `{"id":1}`, wantErr: true},
+		{name: "invalid JSON", raw: `{`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cursorString([]byte(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected an error: %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
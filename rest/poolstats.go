@@ -0,0 +1,177 @@
+package rest
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// HostStats are the connection stats of a host of a CustomPool. Hosts are
+// identified by their "host:port" address.
+type HostStats struct {
+	// Connections with a request in flight
+	InFlight int
+
+	// Open connections waiting for a request. With HTTP/2 several requests
+	// share a connection, so it is an estimate.
+	Idle int
+
+	// Connections dialed since the pool was created
+	Dialed int64
+
+	// Requests sent on a reused connection since the pool was created
+	Reused int64
+}
+
+type hostCounters struct {
+	open     int
+	inFlight int
+	dialed   int64
+	reused   int64
+}
+
+type poolStats struct {
+	mtx   sync.Mutex
+	hosts map[string]*hostCounters
+}
+
+// Stats returns the connection stats of each host the pool connected to.
+func (cp *CustomPool) Stats() map[string]HostStats {
+	return cp.stats.snapshot()
+}
+
+func (s *poolStats) snapshot() map[string]HostStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	stats := make(map[string]HostStats, len(s.hosts))
+	for host, c := range s.hosts {
+		idle := c.open - c.inFlight
+		if idle < 0 {
+			idle = 0
+		}
+		stats[host] = HostStats{InFlight: c.inFlight, Idle: idle, Dialed: c.dialed, Reused: c.reused}
+	}
+	return stats
+}
+
+func (s *poolStats) update(host string, f func(c *hostCounters)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.hosts == nil {
+		s.hosts = make(map[string]*hostCounters)
+	}
+	c, ok := s.hosts[host]
+	if !ok {
+		c = new(hostCounters)
+		s.hosts[host] = c
+	}
+	f(c)
+}
+
+// dialContext counts the open connections of each address.
+func (s *poolStats) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		s.update(addr, func(c *hostCounters) { c.open++ })
+		return &countedConn{Conn: conn, closed: func() {
+			s.update(addr, func(c *hostCounters) { c.open-- })
+		}}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.closed)
+	return c.Conn.Close()
+}
+
+// statsTransport counts, through a client trace, the connections each
+// request gets and how long it keeps them.
+type statsTransport struct {
+	next  http.RoundTripper
+	stats *poolStats
+}
+
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := canonicalAddr(req)
+
+	var gotConn sync.Once
+	got := false
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			gotConn.Do(func() {
+				got = true
+				t.stats.update(host, func(c *hostCounters) {
+					c.inFlight++
+					if info.Reused {
+						c.reused++
+					} else {
+						c.dialed++
+					}
+				})
+			})
+		},
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	release := func() {
+		if got {
+			t.stats.update(host, func(c *hostCounters) { c.inFlight-- })
+		}
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	resp.Body = &releasedBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasedBody calls release once the body is read or closed.
+type releasedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *releasedBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// canonicalAddr returns the "host:port" address of the request URL, like the
+// one the transport dials.
+func canonicalAddr(req *http.Request) string {
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
@@ -0,0 +1,28 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/matiasnu/go-jopit-toolkit/golimiter"
+)
+
+// rateLimit returns a handler that takes the tokens of each attempt from the
+// RequestBuilder RateLimiter before sending it with next. It waits for them,
+// bounded by the request context, or fails fast with
+// golimiter.OverQuotaError if RateLimitFailFast is set.
+func (rb *RequestBuilder) rateLimit(next Handler, weight uint64) Handler {
+	if weight == 0 {
+		weight = 1
+	}
+
+	return func(req *http.Request) *Response {
+		if rb.RateLimitFailFast {
+			if !rb.RateLimiter.Allow(weight) {
+				return &Response{Err: golimiter.OverQuotaError}
+			}
+		} else if err := rb.RateLimiter.Wait(req.Context(), weight); err != nil {
+			return &Response{Err: err}
+		}
+		return next(req)
+	}
+}
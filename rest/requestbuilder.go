@@ -7,12 +7,10 @@ import (
 
 	"github.com/matiasnu/go-jopit-toolkit/golimiter"
 	"github.com/matiasnu/go-jopit-toolkit/goutils"
+	"github.com/matiasnu/go-jopit-toolkit/rest/metrics"
 	"github.com/matiasnu/go-jopit-toolkit/rest/retry"
 )
 
-// Retry rate limiter
-var retryLimiter *golimiter.Limiter
-
 // DefaultTimeout is the default timeout for all clients.
 // DefaultConnectTimeout is the time it takes to make a connection
 // Type: time.Duration
@@ -20,13 +18,19 @@ var DefaultTimeout = 500 * time.Millisecond
 
 var DefaultConnectTimeout = 1500 * time.Millisecond
 
+// DefaultIdleConnTimeout is the time idle connections are kept open.
+var DefaultIdleConnTimeout = 90 * time.Second
+
+// DefaultTLSHandshakeTimeout is the time allowed for TLS handshakes.
+var DefaultTLSHandshakeTimeout = 10 * time.Second
+
 // DefaultMaxIdleConnsPerHost is the default maximum idle connections to have
 // per Host for all clients, that use any RequestBuilder that don't set
 // a CustomPool
 var DefaultMaxIdleConnsPerHost = 2
 
 // ContentType represents the Content Type for the Body of HTTP Verbs like
-// POST, PUT, and PATCH
+// POST, PUT, and PATCH. New ones can be added with RegisterCodec.
 type ContentType int
 
 const (
@@ -41,6 +45,19 @@ const (
 
 	// MULTIPART represents a Multipart content type
 	MULTIPART
+
+	// FORM represents an URL encoded form Content Type. Its requests send no
+	// Accept header, since forms are usually answered with other types.
+	FORM
+
+	// MSGPACK represents a MessagePack Content Type
+	MSGPACK
+
+	// PROTOBUF represents a Protocol Buffers Content Type
+	PROTOBUF
+
+	// NDJSON represents a newline delimited JSON Content Type
+	NDJSON
 )
 
 // RequestBuilder is the baseline for creating requests
@@ -69,6 +86,11 @@ type RequestBuilder struct {
 	// If no ResourceCache is provided, the client will use a default implementation
 	EnableCache bool
 
+	// Optional storage for the cached responses
+	ResourceCache ResourceCache
+	cacheMtxOnce  sync.Once
+	revalidations sync.Map
+
 	// Disable timeout and default timeout = no timeout
 	DisableTimeout bool
 
@@ -82,6 +104,9 @@ type RequestBuilder struct {
 	// Set Basic Auth for this RequestBuilder
 	BasicAuth *BasicAuth
 
+	// Optional source of the bearer tokens sent on each request
+	TokenSource TokenSource
+
 	// Set an specific User Agent for this RequestBuilder
 	UserAgent string
 
@@ -90,13 +115,65 @@ type RequestBuilder struct {
 	Client        *http.Client
 
 	poolNameMtxOnce sync.Once
+	poolNameSet     uint32
 
 	// Optional retry strategy
 	RetryStrategy retry.RetryStrategy
 
-	// If true, automatically uncompress the response body for supported formats
+	// Optional interceptors, run in order around every request attempt
+	Interceptors []Interceptor
+
+	// Optional load balancer across several base URLs. If set, BaseURL is
+	// ignored and retries prefer an endpoint not tried yet.
+	LoadBalancer *LoadBalancer
+
+	// Send a generated IDEMPOTENCY_HEADER on POST and PATCH requests, the
+	// same on all their attempts. With servers that support it, the
+	// RetryStrategy may then include these verbs.
+	IdempotencyKeys bool
+
+	// Optional debug mode, that logs every request and response through
+	// goutils/logger with their secrets masked
+	Debug           *DebugConfig
+	redactor        *redactor
+	redactorMtxOnce sync.Once
+
+	// Optional limiter of the requests sent, to respect the quota of an API
+	RateLimiter *golimiter.Limiter
+
+	// Fail with golimiter.OverQuotaError instead of waiting for the limiter
+	RateLimitFailFast bool
+
+	// Optional deduplication of identical GET requests in flight
+	Dedup      *DedupConfig
+	flights    map[string]*flight
+	flightsMtx sync.Mutex
+
+	// Optional hedging of slow requests
+	Hedging *HedgingPolicy
+
+	// Optional circuit breaker, takes precedence over the CustomPool one
+	CircuitBreaker *CircuitBreaker
+
+	// Optional budget that limits the retries of this RequestBuilder. If nil,
+	// a budget shared by all its hosts is used.
+	RetryBudget        *RetryBudget
+	retryBudgetMtxOnce sync.Once
+
+	// If true, negotiate the compression of the response and automatically
+	// uncompress its body. Supports gzip, deflate and br (brotli).
 	UncompressResponse bool
 
+	// If true, gzip the request bodies of at least CompressMinSize bytes
+	CompressRequest bool
+
+	// Minimum size of the compressed request bodies, DefaultCompressMinSize if 0
+	CompressMinSize int
+
+	// Maximum size of the response body, reading a bigger one fails with
+	// ErrBodyTooLarge. 0 means no limit.
+	MaxBodySize int64
+
 	//Metrics report config
 	MetricsConfig MetricsReportConfig
 
@@ -111,19 +188,57 @@ type MetricsReportConfig struct {
 	DisableHttpConnectionsMetrics bool
 	// True to avoid sending api call metrics (api call requests, api call time, api call result)
 	DisableApiCallMetrics bool
+	// Optional recorder for the metrics, DefaultMetricsRecorder is used if nil
+	Recorder metrics.Recorder
 }
 
 // CustomPool defines a separate internal transport and connection pooling.
+//
+// Zero values of the tuning fields keep the defaults of the transport.
 type CustomPool struct {
 	MaxIdleConnsPerHost int
 	Proxy               string
 
+	// Maximum idle connections across all hosts
+	MaxIdleConns int
+
+	// Maximum connections per host, counting the ones in use. Requests wait
+	// for a connection once it is reached.
+	MaxConnsPerHost int
+
+	// Time an idle connection is kept open, DefaultIdleConnTimeout by default
+	IdleConnTimeout time.Duration
+
+	// Time allowed for the TLS handshake, DefaultTLSHandshakeTimeout by default
+	TLSHandshakeTimeout time.Duration
+
+	// Time allowed to wait for the response headers once the request is sent
+	ResponseHeaderTimeout time.Duration
+
+	// TCP keep-alive period of the connections, a negative value disables it
+	KeepAlive time.Duration
+
+	// Use each connection for a single request
+	DisableKeepAlives bool
+
+	// Don't attempt HTTP/2 on TLS connections
+	DisableHTTP2 bool
+
+	// Optional circuit breaker shared by the RequestBuilders using the pool
+	CircuitBreaker *CircuitBreaker
+
+	// Optional TLS settings of the pool transport
+	TLS *TLSConfig
+
 	// once protects the creation of Transport if on the first usage of
 	// the CustomPool it's nil.
 	once sync.Once
 
 	// Public for custom fine tuning
 	Transport http.RoundTripper
+
+	stats          poolStats
+	statsTransport http.RoundTripper
 }
 
 // BasicAuth gives the possibility to set UserName and Password for a given
@@ -281,7 +396,5 @@ func (rb *RequestBuilder) AsyncOptions(url string, f func(*Response), opts ...Op
 }
 
 func init() {
-	retryLimiter = golimiter.New(1000, time.Second)
-
 	defaultCheckRedirectFunc = http.Client{}.CheckRedirect
 }
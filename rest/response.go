@@ -1,11 +1,9 @@
 package rest
 
 import (
-	"encoding/json"
-	"encoding/xml"
-	"errors"
+	"fmt"
+	"io"
 	"net/http"
-	"net/http/httputil"
 	"regexp"
 	"strings"
 )
@@ -17,6 +15,22 @@ type Response struct {
 	*http.Response
 	Err      error
 	byteBody []byte
+
+	// Body reader of streamed responses
+	stream io.ReadCloser
+
+	// Last request sent, also set when there is no http.Response
+	request *http.Request
+
+	// Masks the secrets of Debug and Curl
+	redactor *redactor
+}
+
+// discard releases the body of a response that won't reach the caller.
+func (r *Response) discard() {
+	if r.stream != nil {
+		drainBody(r.stream)
+	}
 }
 
 // String return the Response Body as a String.
@@ -29,59 +43,22 @@ func (r *Response) Bytes() []byte {
 	return r.byteBody
 }
 
-// FillUp set the fill parameter with the corresponding JSON or XML response.
+// FillUp set the fill parameter with the corresponding response, decoded with
+// the codec registered for its Content-Type (JSON, XML, form, ...).
 // fill could be `struct` or `map[string]interface{}`
 func (r *Response) FillUp(fill interface{}) error {
-	ctypeJSON := "application/json"
-	ctypeXML := "application/xml"
-
 	ctype := strings.ToLower(r.Header.Get("Content-Type"))
 
 	for i := 0; i < 2; i++ {
 
-		switch {
-		case strings.Contains(ctype, ctypeJSON):
-			return json.Unmarshal(r.byteBody, fill)
-		case strings.Contains(ctype, ctypeXML):
-			return xml.Unmarshal(r.byteBody, fill)
-		case i == 0:
+		if codec, ok := codecForMIME(ctype); ok {
+			return codec.Unmarshal(r.byteBody, fill)
+		}
+		if i == 0 {
 			ctype = http.DetectContentType(r.byteBody)
 		}
 
 	}
 
-	return errors.New("Response format neither JSON nor XML")
-}
-
-// Debug let any request/response to be dumped, showing how the request/response
-// went through the wire, only if debug mode is on on RequestBuilder.
-func (r *Response) Debug() string {
-
-	var strReq, strResp string
-
-	if req, err := httputil.DumpRequest(r.Request, true); err != nil {
-		strReq = err.Error()
-	} else {
-		strReq = string(req)
-	}
-
-	if resp, err := httputil.DumpResponse(r.Response, false); err != nil {
-		strResp = err.Error()
-	} else {
-		strResp = string(resp)
-	}
-
-	const separator = "--------\n"
-
-	dump := separator
-	dump += "REQUEST\n"
-	dump += separator
-	dump += strReq
-	dump += "\n" + separator
-	dump += "RESPONSE\n"
-	dump += separator
-	dump += strResp
-	dump += r.String() + "\n"
-
-	return dump
+	return fmt.Errorf("no codec registered for response Content-Type %q", r.Header.Get("Content-Type"))
 }
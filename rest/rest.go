@@ -155,3 +155,11 @@ func AsyncHead(url string, f func(*Response), opts ...Option) {
 func AsyncOptions(url string, f func(*Response), opts ...Option) {
 	dfltBuilder.AsyncOptions(url, f, opts...)
 }
+
+// ForkJoin issues the given requests in parallel, and returns their responses
+// in the same order once all of them are done.
+//
+// ForkJoin uses the DefaultBuilder
+func ForkJoin(config ForkJoinConfig, requests ...ForkJoinRequest) []*Response {
+	return dfltBuilder.ForkJoin(config, requests...)
+}
@@ -0,0 +1,236 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Jitter is the randomization applied to the exponential backoff delay.
+type Jitter int
+
+const (
+	// NoJitter waits exactly base * 2^retries, up to MaxDelay
+	NoJitter Jitter = iota
+
+	// FullJitter waits a random time between 0 and base * 2^retries
+	FullJitter
+
+	// DecorrelatedJitter waits a random time between base and 3 times the
+	// previous delay of the request, up to MaxDelay
+	DecorrelatedJitter
+)
+
+// ErrorClass groups the transport errors that may be retried.
+type ErrorClass int
+
+const (
+	ConnectionRefused ErrorClass = 1 << iota
+	ConnectionReset
+	Timeout
+
+	AllErrors = ConnectionRefused | ConnectionReset | Timeout
+)
+
+var defaultRetriableStatus = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// BackoffConfig configures a backoff RetryStrategy. Zero values take the
+// defaults described on each field.
+type BackoffConfig struct {
+	MaxRetries int
+
+	// Delay of the first retry, 100ms by default
+	BaseDelay time.Duration
+
+	// Cap for the delay of any retry, 10s by default. A Retry-After header
+	// asking for a longer wait stops the retries.
+	MaxDelay time.Duration
+
+	Jitter Jitter
+
+	// Status codes to retry, 429, 502, 503 and 504 by default
+	RetriableStatus []int
+
+	// Transport errors to retry, AllErrors by default
+	RetriableErrors ErrorClass
+
+	// Verbs to retry, GET, HEAD and OPTIONS by default
+	Methods []string
+}
+
+// Exponential Backoff Retry Strategy
+type backoffRetryStrategy struct {
+	config BackoffConfig
+
+	// Previous delay of the request, only set on the strategies returned by
+	// ForRequest
+	prev *time.Duration
+}
+
+func NewBackoffRetryStrategy(config BackoffConfig) RetryStrategy {
+	if config.MaxRetries < 0 || config.BaseDelay < 0 || config.MaxDelay < 0 {
+		return nil
+	}
+	if config.BaseDelay == 0 {
+		config.BaseDelay = 100 * time.Millisecond
+	}
+	if config.MaxDelay == 0 {
+		config.MaxDelay = 10 * time.Second
+	}
+	if len(config.RetriableStatus) == 0 {
+		config.RetriableStatus = defaultRetriableStatus
+	}
+	if config.RetriableErrors == 0 {
+		config.RetriableErrors = AllErrors
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = defaultRetriableMethods
+	}
+	return backoffRetryStrategy{config: config}
+}
+
+func (r backoffRetryStrategy) ShouldRetry(req *http.Request, resp *http.Response, err error, retries int) RetryResponse {
+	if retries >= r.config.MaxRetries || !isMethodAllowed(req.Method, r.config.Methods) {
+		return &retryResponse{false, 0}
+	}
+
+	if err != nil {
+		return &retryResponse{r.config.RetriableErrors&classify(err) != 0, r.backoff(retries)}
+	}
+
+	if !isStatusAllowed(resp.StatusCode, r.config.RetriableStatus) {
+		return &retryResponse{false, 0}
+	}
+
+	delay := r.backoff(retries)
+	if retryAfter, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		if retryAfter > r.config.MaxDelay {
+			return &retryResponse{false, 0}
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+	}
+
+	return &retryResponse{true, delay}
+}
+
+// backoff returns the delay before the given retry.
+func (r backoffRetryStrategy) backoff(retries int) time.Duration {
+	base := float64(r.config.BaseDelay)
+	max := float64(r.config.MaxDelay)
+
+	switch r.config.Jitter {
+	case FullJitter:
+		return time.Duration(rand.Int63n(int64(math.Min(max, base*math.Pow(2, float64(retries)))) + 1))
+	case DecorrelatedJitter:
+		prev := base
+		if r.prev != nil && *r.prev > 0 {
+			prev = float64(*r.prev)
+		}
+
+		delay := time.Duration(math.Min(max, base))
+		if upper := math.Min(max, prev*3); upper > base {
+			delay = time.Duration(base) + time.Duration(rand.Int63n(int64(upper-base)+1))
+		}
+		if r.prev != nil {
+			*r.prev = delay
+		}
+		return delay
+	default:
+		return time.Duration(math.Min(max, base*math.Pow(2, float64(retries))))
+	}
+}
+
+// ForRequest returns a strategy that keeps the previous delay of a request,
+// needed by the DecorrelatedJitter. Without it, each delay is computed as if
+// the previous one was BaseDelay.
+func (r backoffRetryStrategy) ForRequest() RetryStrategy {
+	if r.config.Jitter != DecorrelatedJitter {
+		return r
+	}
+	r.prev = new(time.Duration)
+	return r
+}
+
+func (r backoffRetryStrategy) GetParams() map[string]interface{} {
+
+	return map[string]interface{}{
+		"max_retries": r.config.MaxRetries,
+		"base_delay":  strconv.Itoa(int(r.config.BaseDelay.Seconds() * 1000)),
+		"max_delay":   strconv.Itoa(int(r.config.MaxDelay.Seconds() * 1000)),
+		"jitter":      int(r.config.Jitter),
+	}
+}
+
+func (r backoffRetryStrategy) Clone(verbs ...string) RetryStrategy {
+	config := r.config
+	config.Methods = verbs
+	return NewBackoffRetryStrategy(config)
+}
+
+// ParseRetryAfter parses a Retry-After header value, either in seconds or as
+// an HTTP date, into the time to wait from now.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// classify returns the ErrorClass of a transport error, or 0 if it is not a
+// known retriable error.
+func classify(err error) ErrorClass {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ConnectionReset
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return Timeout
+	}
+
+	return 0
+}
+
+func isStatusAllowed(status int, allowedStatus []int) bool {
+	for i := 0; i < len(allowedStatus); i++ {
+		if allowedStatus[i] == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{name: "empty", value: "", wantOk: false},
+		{name: "seconds", value: "120", want: 2 * time.Minute, wantOk: true},
+		{name: "seconds with spaces", value: " 5 ", want: 5 * time.Second, wantOk: true},
+		{name: "zero seconds", value: "0", want: 0, wantOk: true},
+		{name: "negative seconds", value: "-1", wantOk: false},
+		{name: "future date", value: now.Add(30 * time.Second).Format(http.TimeFormat), want: 30 * time.Second, wantOk: true},
+		{name: "past date", value: now.Add(-time.Hour).Format(http.TimeFormat), want: 0, wantOk: true},
+		{name: "invalid", value: "soon", wantOk: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseRetryAfter(tt.value, now)
+			if ok != tt.wantOk || got != tt.want {
+				t.Fatalf("got %v, %t, expected %v, %t", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{name: "connection refused", err: opError(syscall.ECONNREFUSED), want: ConnectionRefused},
+		{name: "connection reset", err: opError(syscall.ECONNRESET), want: ConnectionReset},
+		{name: "broken pipe", err: opError(syscall.EPIPE), want: ConnectionReset},
+		{name: "EOF", err: fmt.Errorf("read: %w", io.EOF), want: ConnectionReset},
+		{name: "unexpected EOF", err: io.ErrUnexpectedEOF, want: ConnectionReset},
+		{name: "net timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, want: Timeout},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: Timeout},
+		{name: "canceled", err: context.Canceled, want: 0},
+		{name: "unknown", err: errors.New("boom"), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classify(tt.err); got != tt.want {
+				t.Fatalf("got class %d, expected %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffBounds(t *testing.T) {
+	const (
+		base    = 100 * time.Millisecond
+		max     = time.Second
+		retries = 8
+		runs    = 200
+	)
+
+	exponential := func(retries int) time.Duration {
+		return time.Duration(math.Min(float64(max), float64(base)*math.Pow(2, float64(retries))))
+	}
+
+	tests := []struct {
+		name   string
+		jitter Jitter
+		// bounds returns the minimum and maximum delay of a retry, given the
+		// previous delay of the request
+		bounds func(retries int, prev time.Duration) (time.Duration, time.Duration)
+	}{
+		{
+			name:   "no jitter",
+			jitter: NoJitter,
+			bounds: func(retries int, prev time.Duration) (time.Duration, time.Duration) {
+				return exponential(retries), exponential(retries)
+			},
+		},
+		{
+			name:   "full jitter",
+			jitter: FullJitter,
+			bounds: func(retries int, prev time.Duration) (time.Duration, time.Duration) {
+				return 0, exponential(retries)
+			},
+		},
+		{
+			name:   "decorrelated jitter",
+			jitter: DecorrelatedJitter,
+			bounds: func(retries int, prev time.Duration) (time.Duration, time.Duration) {
+				if prev == 0 {
+					prev = base
+				}
+				upper := 3 * prev
+				if upper > max {
+					upper = max
+				}
+				return base, upper
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := NewBackoffRetryStrategy(BackoffConfig{MaxRetries: retries, BaseDelay: base, MaxDelay: max, Jitter: tt.jitter})
+
+			var longest time.Duration
+			for run := 0; run < runs; run++ {
+				r := strategy.(RequestStrategy).ForRequest().(backoffRetryStrategy)
+
+				var prev time.Duration
+				for i := 0; i < retries; i++ {
+					min, upper := tt.bounds(i, prev)
+					delay := r.backoff(i)
+					if delay < min || delay > upper || delay > max {
+						t.Fatalf("retry %d after %v: delay %v out of [%v, %v]", i, prev, delay, min, upper)
+					}
+					prev = delay
+					if delay > longest {
+						longest = delay
+					}
+				}
+			}
+
+			// Delays grow with the retries of a request
+			if longest <= 3*base {
+				t.Fatalf("longest delay is %v, expected more than %v", longest, 3*base)
+			}
+		})
+	}
+}
+
+func TestBackoffRetryAfter(t *testing.T) {
+	strategy := NewBackoffRetryStrategy(BackoffConfig{MaxRetries: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 10 * time.Second})
+	req, _ := http.NewRequest(http.MethodGet, "http://api.example", nil)
+
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		wantRetry  bool
+		wantDelay  time.Duration
+	}{
+		{name: "retriable status", status: http.StatusServiceUnavailable, wantRetry: true, wantDelay: 100 * time.Millisecond},
+		{name: "other status", status: http.StatusInternalServerError, wantRetry: false},
+		{name: "longer Retry-After", status: http.StatusTooManyRequests, retryAfter: "2", wantRetry: true, wantDelay: 2 * time.Second},
+		{name: "shorter Retry-After", status: http.StatusTooManyRequests, retryAfter: "0", wantRetry: true, wantDelay: 100 * time.Millisecond},
+		{name: "Retry-After over MaxDelay", status: http.StatusTooManyRequests, retryAfter: "60", wantRetry: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+
+			got := strategy.ShouldRetry(req, resp, nil, 0)
+			if got.Retry() != tt.wantRetry || (tt.wantRetry && got.Delay() != tt.wantDelay) {
+				t.Fatalf("got retry %t after %v, expected %t after %v", got.Retry(), got.Delay(), tt.wantRetry, tt.wantDelay)
+			}
+		})
+	}
+}
@@ -11,6 +11,13 @@ type RetryStrategy interface {
 	ShouldRetry(req *http.Request, resp *http.Response, err error, retries int) RetryResponse
 }
 
+// RequestStrategy is implemented by the RetryStrategies that keep state
+// across the retries of a request. ForRequest returns the strategy used for
+// the retries of a single request.
+type RequestStrategy interface {
+	ForRequest() RetryStrategy
+}
+
 type RetryResponse interface {
 	Retry() bool
 	Delay() time.Duration
@@ -0,0 +1,115 @@
+package rest
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultRetryBudgetMaxTokens and DefaultRetryBudgetTokenRatio configure the
+// RetryBudget of any RequestBuilder that doesn't set one.
+var DefaultRetryBudgetMaxTokens = 10.0
+
+var DefaultRetryBudgetTokenRatio = 0.1
+
+// RetryBudget limits the retries of a RequestBuilder as a ratio of its
+// successful requests, the same way gRPC retry throttling does.
+//
+// Each scope (the whole RequestBuilder, or each host) starts with maxTokens.
+// Every failed request takes one token and every successful one gives back
+// tokenRatio tokens. Retries are only allowed while more than half of the
+// tokens are left.
+type RetryBudget struct {
+	maxTokens  float64
+	tokenRatio float64
+	perHost    bool
+
+	mtx    sync.Mutex
+	tokens map[string]float64
+	denied uint64
+}
+
+// NewRetryBudget returns a RetryBudget shared by all the hosts of the
+// RequestBuilder, or one per host if perHost is true.
+func NewRetryBudget(maxTokens float64, tokenRatio float64, perHost bool) *RetryBudget {
+	return &RetryBudget{
+		maxTokens:  maxTokens,
+		tokenRatio: tokenRatio,
+		perHost:    perHost,
+		tokens:     make(map[string]float64),
+	}
+}
+
+// Denied returns how many retries were denied by the budget.
+func (b *RetryBudget) Denied() uint64 {
+	return atomic.LoadUint64(&b.denied)
+}
+
+// Tokens returns the tokens left for the host.
+func (b *RetryBudget) Tokens(host string) float64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.get(b.scope(host))
+}
+
+func (b *RetryBudget) record(host string, success bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	scope := b.scope(host)
+	tokens := b.get(scope)
+	if success {
+		tokens += b.tokenRatio
+		if tokens > b.maxTokens {
+			tokens = b.maxTokens
+		}
+	} else {
+		tokens--
+		if tokens < 0 {
+			tokens = 0
+		}
+	}
+	b.tokens[scope] = tokens
+}
+
+func (b *RetryBudget) allow(host string) bool {
+	b.mtx.Lock()
+	allowed := b.get(b.scope(host)) > b.maxTokens/2
+	b.mtx.Unlock()
+
+	if !allowed {
+		atomic.AddUint64(&b.denied, 1)
+	}
+	return allowed
+}
+
+func (b *RetryBudget) get(scope string) float64 {
+	tokens, ok := b.tokens[scope]
+	if !ok {
+		return b.maxTokens
+	}
+	return tokens
+}
+
+func (b *RetryBudget) scope(host string) string {
+	if b.perHost {
+		return host
+	}
+	return ""
+}
+
+func (rb *RequestBuilder) getRetryBudget() *RetryBudget {
+	rb.retryBudgetMtxOnce.Do(func() {
+		if rb.RetryBudget == nil {
+			rb.RetryBudget = NewRetryBudget(DefaultRetryBudgetMaxTokens, DefaultRetryBudgetTokenRatio, false)
+		}
+	})
+
+	return rb.RetryBudget
+}
+
+// isFailure tells whether a request outcome takes tokens from the budget.
+func isFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"testing"
+)
+
+func TestRetryBudget(t *testing.T) {
+	type outcome struct {
+		host    string
+		success bool
+	}
+
+	failures := func(host string, n int) []outcome {
+		o := make([]outcome, n)
+		for i := range o {
+			o[i] = outcome{host: host}
+		}
+		return o
+	}
+	successes := func(host string, n int) []outcome {
+		o := failures(host, n)
+		for i := range o {
+			o[i].success = true
+		}
+		return o
+	}
+
+	tests := []struct {
+		name       string
+		perHost    bool
+		outcomes   []outcome
+		host       string
+		wantTokens float64
+		wantAllow  bool
+	}{
+		{name: "starts full", host: "a", wantTokens: 10, wantAllow: true},
+		{name: "failures take a token each", outcomes: failures("a", 3), host: "a", wantTokens: 7, wantAllow: true},
+		{name: "half the tokens deny retries", outcomes: failures("a", 5), host: "a", wantTokens: 5, wantAllow: false},
+		{name: "tokens never go below zero", outcomes: failures("a", 20), host: "a", wantTokens: 0, wantAllow: false},
+		{name: "successes give back the ratio", outcomes: append(failures("a", 5), successes("a", 10)...), host: "a", wantTokens: 7, wantAllow: true},
+		{name: "tokens never go above the max", outcomes: successes("a", 10), host: "a", wantTokens: 10, wantAllow: true},
+		{name: "shared budget counts every host", outcomes: failures("a", 5), host: "b", wantTokens: 5, wantAllow: false},
+		{name: "per host budget counts each host", perHost: true, outcomes: failures("a", 5), host: "b", wantTokens: 10, wantAllow: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := NewRetryBudget(10, 0.2, tt.perHost)
+			for _, o := range tt.outcomes {
+				budget.record(o.host, o.success)
+			}
+
+			if tokens := budget.Tokens(tt.host); tokens < tt.wantTokens-1e-9 || tokens > tt.wantTokens+1e-9 {
+				t.Fatalf("got %v tokens, expected %v", tokens, tt.wantTokens)
+			}
+			if allowed := budget.allow(tt.host); allowed != tt.wantAllow {
+				t.Fatalf("retry allowed: %t, expected %t", allowed, tt.wantAllow)
+			}
+
+			wantDenied := uint64(0)
+			if !tt.wantAllow {
+				wantDenied = 1
+			}
+			if denied := budget.Denied(); denied != wantDenied {
+				t.Fatalf("got %d denied retries, expected %d", denied, wantDenied)
+			}
+		})
+	}
+}
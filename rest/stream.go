@@ -0,0 +1,91 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// ErrBodyTooLarge is the error of reading a response body bigger than the
+// RequestBuilder MaxBodySize.
+var ErrBodyTooLarge = errors.New("response body too large")
+
+// Reader returns the response body. On responses of requests issued with
+// the Stream option it is read from the wire as it is consumed, and the
+// caller must close it. On any other response it reads the buffered body.
+func (r *Response) Reader() io.ReadCloser {
+	if r.stream != nil {
+		return r.stream
+	}
+	return ioutil.NopCloser(bytes.NewReader(r.byteBody))
+}
+
+// streamBody returns the body of the response, uncompressed if it is encoded
+// and bounded by the RequestBuilder MaxBodySize.
+func (rb *RequestBuilder) streamBody(resp *http.Response) (io.ReadCloser, error) {
+	var reader io.Reader = resp.Body
+
+	encoding := resp.Header.Get("Content-Encoding")
+	if rb.UncompressResponse {
+		encoding = responseEncoding(resp)
+	}
+	if encoding != "" && supportedEncoding(encoding) {
+		br := bufio.NewReader(resp.Body)
+		if _, err := br.Peek(1); err == io.EOF {
+			// Empty body, nothing to uncompress
+			return resp.Body, nil
+		}
+
+		var err error
+		if reader, err = uncompress(br, encoding); err != nil {
+			return nil, err
+		}
+		uncompressed(resp)
+	}
+
+	return &limitedBody{reader: reader, closer: resp.Body, limit: rb.MaxBodySize}, nil
+}
+
+// limitedBody reads up to limit bytes from its reader, failing with
+// ErrBodyTooLarge if there are more. A limit of 0 means no limit.
+type limitedBody struct {
+	reader io.Reader
+	closer io.Closer
+	limit  int64
+	read   int64
+}
+
+func limitBody(body io.Reader, limit int64) io.Reader {
+	return &limitedBody{reader: body, limit: limit}
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.limit <= 0 {
+		return l.reader.Read(p)
+	}
+
+	// Read one byte past the limit to know whether the body exceeds it
+	left := l.limit - l.read
+	if int64(len(p)) > left+1 {
+		p = p[:left+1]
+	}
+
+	n, err := l.reader.Read(p)
+	if int64(n) > left {
+		l.read = l.limit
+		return int(left), fmt.Errorf("%w: limit is %d bytes", ErrBodyTooLarge, l.limit)
+	}
+	l.read += int64(n)
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
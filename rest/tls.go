@@ -0,0 +1,319 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig declares the TLS settings of the transport of a CustomPool.
+type TLSConfig struct {
+	// PEM encoded client certificate and key files, for mutual TLS
+	CertFile string
+	KeyFile  string
+
+	// PEM encoded CA certificates trusted besides the system ones
+	RootCAs []byte
+
+	// PEM encoded CA certificate files trusted besides the system ones
+	RootCAFiles []string
+
+	// Minimum TLS version, like tls.VersionTLS13. TLS 1.2 by default
+	MinVersion uint16
+
+	// Server name verified and sent in the SNI extension, instead of the host
+	// of the request URL
+	ServerName string
+
+	// Optional base64 encoded SHA-256 hashes of the SubjectPublicKeyInfo of
+	// the accepted certificates. The verified chain of the server must have a
+	// certificate with one of them.
+	PinnedKeys []string
+
+	// How often the certificate and CA files are checked for changes, which
+	// are reloaded without restarting. 0 disables the reload.
+	ReloadInterval time.Duration
+
+	// Don't verify the server certificate, only for tests
+	InsecureSkipVerify bool
+}
+
+// tlsFiles keeps the certificates loaded from the TLSConfig files, reloading
+// them when they change.
+type tlsFiles struct {
+	config TLSConfig
+
+	mtx     sync.Mutex
+	checked time.Time
+	modTime time.Time
+	cert    *tls.Certificate
+	roots   *x509.CertPool
+}
+
+func newTLSFiles(config TLSConfig) (*tlsFiles, error) {
+	f := &tlsFiles{config: config}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+// load reads every file of the config.
+func (f *tlsFiles) load() error {
+	modTime, err := f.lastModified()
+	if err != nil {
+		return err
+	}
+
+	var cert *tls.Certificate
+	if f.config.CertFile != "" || f.config.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(f.config.CertFile, f.config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tls: cannot load client certificate: %w", err)
+		}
+		cert = &c
+	}
+
+	roots := systemCertPool()
+	if len(f.config.RootCAs) > 0 && !roots.AppendCertsFromPEM(f.config.RootCAs) {
+		return errors.New("tls: no certificates found in RootCAs")
+	}
+	for _, file := range f.config.RootCAFiles {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("tls: cannot read CA file: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls: no certificates found in %s", file)
+		}
+	}
+
+	f.cert, f.roots, f.modTime = cert, roots, modTime
+	return nil
+}
+
+// refresh reloads the files if the ReloadInterval elapsed and any of them
+// changed. On errors it keeps the certificates loaded before.
+func (f *tlsFiles) refresh() {
+	if f.config.ReloadInterval <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(f.checked) < f.config.ReloadInterval {
+		return
+	}
+	f.checked = now
+
+	if modTime, err := f.lastModified(); err == nil && modTime.After(f.modTime) {
+		f.load()
+	}
+}
+
+func (f *tlsFiles) lastModified() (time.Time, error) {
+	var last time.Time
+
+	files := append([]string{}, f.config.RootCAFiles...)
+	if f.config.CertFile != "" {
+		files = append(files, f.config.CertFile, f.config.KeyFile)
+	}
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return last, fmt.Errorf("tls: %w", err)
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+func (f *tlsFiles) current() (*tls.Certificate, *x509.CertPool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.refresh()
+	return f.cert, f.roots
+}
+
+// reloadable returns whether the CA files may change, so the server
+// certificate must be verified with the current ones on each handshake.
+func (f *tlsFiles) reloadable() bool {
+	return f.config.ReloadInterval > 0 && len(f.config.RootCAFiles) > 0
+}
+
+// clientConfig returns the tls.Config of the transport.
+func (f *tlsFiles) clientConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:         f.config.MinVersion,
+		ServerName:         f.config.ServerName,
+		InsecureSkipVerify: f.config.InsecureSkipVerify,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if f.config.CertFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := f.current()
+			return cert, nil
+		}
+	}
+
+	if f.reloadable() && !f.config.InsecureSkipVerify {
+		// The standard verification only knows the roots of the tls.Config
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = f.verifyConnection
+		return config
+	}
+
+	if len(f.config.RootCAs) > 0 || len(f.config.RootCAFiles) > 0 {
+		_, config.RootCAs = f.current()
+	}
+	if len(f.config.PinnedKeys) > 0 {
+		config.VerifyConnection = f.verifyConnection
+	}
+	return config
+}
+
+// verifyConnection verifies the server certificate with the current roots
+// when they are reloadable, and checks the pinned keys.
+func (f *tlsFiles) verifyConnection(cs tls.ConnectionState) error {
+	// The state has no server name for IP addresses, which are verified by
+	// the connections of dialTLS
+	host := cs.ServerName
+	if host == "" {
+		host = f.config.ServerName
+	}
+	return f.verify(cs, host)
+}
+
+// verify verifies the server certificate of a connection to host.
+func (f *tlsFiles) verify(cs tls.ConnectionState, host string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: server sent no certificates")
+	}
+
+	chains := cs.VerifiedChains
+	if f.reloadable() && !f.config.InsecureSkipVerify {
+		if host == "" {
+			return errors.New("tls: cannot verify the server certificate without a server name")
+		}
+
+		_, roots := f.current()
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		var err error
+		chains, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(f.config.PinnedKeys) == 0 {
+		return nil
+	}
+
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{cs.PeerCertificates}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if pinned(cert, f.config.PinnedKeys) {
+				return nil
+			}
+		}
+	}
+	return errors.New("tls: no certificate of the server matches the pinned keys")
+}
+
+// dialTLS returns the DialTLSContext of a transport whose server certificates
+// are verified by hand, checking them against the dialed host.
+func (f *tlsFiles) dialTLS(transport *http.Transport) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := transport.DialContext
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// The transport adds the HTTP/2 protocols to its config before dialing
+		config := transport.TLSClientConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		serverName := config.ServerName
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return f.verify(cs, serverName)
+		}
+
+		if timeout := transport.TLSHandshakeTimeout; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func pinned(cert *x509.Certificate, pins []string) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if decoded, err := base64.StdEncoding.DecodeString(pin); err == nil && bytes.Equal(decoded, hash[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func systemCertPool() *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		return x509.NewCertPool()
+	}
+	return pool
+}
+
+// errorTransport fails every request with the error of building the real
+// transport, like an invalid TLSConfig.
+type errorTransport struct {
+	err error
+}
+
+func (t errorTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
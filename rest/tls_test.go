@@ -0,0 +1,235 @@
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues the certificates of the test
+// servers.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rest test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a server certificate for the given DNS names and IPs.
+func (ca *testCA) issue(t *testing.T, dnsNames []string, ips []net.IP) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "rest test server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) file(t *testing.T) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func newTLSServer(t *testing.T, cert tls.Certificate) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func spkiPin(cert tls.Certificate) string {
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+	hash := sha256.Sum256(parsed.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestTLSServerVerification(t *testing.T) {
+	ca := newTestCA(t)
+	loopback := []net.IP{net.ParseIP("127.0.0.1")}
+
+	otherName := ca.issue(t, []string{"other.example"}, nil)
+	ipCert := ca.issue(t, nil, loopback)
+	unknownCA := newTestCA(t).issue(t, nil, loopback)
+
+	tests := []struct {
+		name    string
+		cert    tls.Certificate
+		config  func(caFile string) TLSConfig
+		wantErr bool
+	}{
+		{
+			name: "reloadable roots reject a cert for another name on an IP host",
+			cert: otherName,
+			config: func(caFile string) TLSConfig {
+				return TLSConfig{RootCAFiles: []string{caFile}, ReloadInterval: time.Minute}
+			},
+			wantErr: true,
+		},
+		{
+			name: "reloadable roots accept a cert for the IP host",
+			cert: ipCert,
+			config: func(caFile string) TLSConfig {
+				return TLSConfig{RootCAFiles: []string{caFile}, ReloadInterval: time.Minute}
+			},
+		},
+		{
+			name: "reloadable roots verify the configured server name",
+			cert: otherName,
+			config: func(caFile string) TLSConfig {
+				return TLSConfig{RootCAFiles: []string{caFile}, ReloadInterval: time.Minute, ServerName: "other.example"}
+			},
+		},
+		{
+			name: "reloadable roots reject an unknown CA",
+			cert: unknownCA,
+			config: func(caFile string) TLSConfig {
+				return TLSConfig{RootCAFiles: []string{caFile}, ReloadInterval: time.Minute}
+			},
+			wantErr: true,
+		},
+		{
+			name: "static roots reject a cert for another name on an IP host",
+			cert: otherName,
+			config: func(caFile string) TLSConfig {
+				return TLSConfig{RootCAFiles: []string{caFile}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "static roots accept a cert for the IP host",
+			cert: ipCert,
+			config: func(caFile string) TLSConfig {
+				return TLSConfig{RootCAFiles: []string{caFile}}
+			},
+		},
+		{
+			name: "pinned key matches",
+			cert: ipCert,
+			config: func(caFile string) TLSConfig {
+				return TLSConfig{RootCAFiles: []string{caFile}, PinnedKeys: []string{spkiPin(ipCert)}}
+			},
+		},
+		{
+			name: "pinned key doesn't match",
+			cert: ipCert,
+			config: func(caFile string) TLSConfig {
+				return TLSConfig{RootCAFiles: []string{caFile}, PinnedKeys: []string{spkiPin(otherName)}}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTLSServer(t, tt.cert)
+			config := tt.config(ca.file(t))
+
+			rb := &RequestBuilder{
+				BaseURL:    server.URL,
+				CustomPool: &CustomPool{MaxIdleConnsPerHost: 1, TLS: &config},
+			}
+
+			resp := rb.Get("/")
+			if tt.wantErr {
+				if resp.Err == nil {
+					t.Fatalf("expected a TLS error, got status %d", resp.StatusCode)
+				}
+				return
+			}
+			if resp.Err != nil {
+				t.Fatalf("unexpected error: %v", resp.Err)
+			}
+			if resp.String() != "ok" {
+				t.Fatalf("unexpected body %q", resp.String())
+			}
+		})
+	}
+}
+
+func TestTLSVerifyConnectionFailsClosedWithoutServerName(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, []string{"other.example"}, nil)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := newTLSFiles(TLSConfig{RootCAFiles: []string{ca.file(t)}, ReloadInterval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connections through a proxy are verified with the state alone
+	if err := files.verifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{parsed}}); err == nil {
+		t.Fatal("expected an error without a server name")
+	}
+}